@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/docker/docker/pkg/namesgenerator"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Advertiser struct {
@@ -21,6 +29,38 @@ func GetAdvertiser() *Advertiser {
 
 func (ad *Advertiser) Apply(req *http.Request) {
 	req.Header.Set("X-Advertiser-Id", fmt.Sprintf("%d", ad.Id))
+
+	if AdvertiserSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		req.Header.Set("X-Advertiser-Timestamp", timestamp)
+		req.Header.Set("X-Advertiser-Nonce", hex.EncodeToString(nonce))
+		req.Header.Set("X-Advertiser-Signature", ad.Sign(req, timestamp, hex.EncodeToString(nonce)))
+	}
+}
+
+// Key はウェブアプリと共有している AdvertiserSecret から導出した広告主の鍵
+func (ad *Advertiser) Key() []byte {
+	mac := hmac.New(sha256.New, []byte(AdvertiserSecret))
+	mac.Write([]byte(fmt.Sprintf("advertiser:%d", ad.Id)))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Sign はリクエストの署名。ボディは読んだものを戻しておく
+func (ad *Advertiser) Sign(req *http.Request, timestamp, nonce string) string {
+	body := []byte{}
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	digest := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, ad.Key())
+	mac.Write([]byte(req.Method + "\n" + req.URL.Path + "\n" + req.URL.RawQuery + "\n" +
+		timestamp + "\n" + nonce + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (ad *Advertiser) NewSlot() *Slot {
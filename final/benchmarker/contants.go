@@ -52,6 +52,9 @@ const (
 
 var ApiKey = envdef.Get("ISUCON_API_KEY", "None")
 
+// ウェブアプリの ISU4_ADVERTISER_SECRET と同じ値を設定すると広告主のリクエストに署名する
+var AdvertiserSecret = envdef.Get("HALLEY_ADVERTISER_SECRET", "")
+
 const (
 	TimeFormat = "2006-01-02 15:04:05"
 )
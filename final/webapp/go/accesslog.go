@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// AccessLog is one JSON line of the access log. Route is the template the
+// request matched, "" for static files and misses.
+type AccessLog struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Route   string    `json:"route"`
+	Slot    string    `json:"slot,omitempty"`
+	AdId    string    `json:"ad_id,omitempty"`
+	Status  int       `json:"status"`
+	Latency float64   `json:"latency"`
+	Bytes   int       `json:"bytes"`
+}
+
+// accessLogWriter is where access logs go, per ISU4_ACCESS_LOG: "-" for
+// stdout, "" to turn them off, or a file to append to.
+var accessLogWriter = newAccessLogWriter(getEnv("ISU4_ACCESS_LOG", "-"))
+
+func newAccessLogWriter(path string) io.Writer {
+	switch path {
+	case "":
+		return nil
+	case "-":
+		return os.Stdout
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+var accessLogMutex sync.Mutex
+
+// routePattern is a registered route compiled the way martini matches it.
+type routePattern struct {
+	method  string
+	pattern string
+	regex   *regexp.Regexp
+}
+
+var routeParamPattern = regexp.MustCompile(`:[^/#?()\.\\]+`)
+
+var (
+	routePatterns     []*routePattern
+	routePatternsOnce sync.Once
+)
+
+func compileRoutes(routes martini.Routes) {
+	for _, route := range routes.All() {
+		pattern := route.Pattern()
+		expr := ""
+		last := 0
+		for _, loc := range routeParamPattern.FindAllStringIndex(pattern, -1) {
+			expr += regexp.QuoteMeta(pattern[last:loc[0]]) + `(?P<` + pattern[loc[0]+1:loc[1]] + `>[^/#?]+)`
+			last = loc[1]
+		}
+		expr += regexp.QuoteMeta(pattern[last:])
+		routePatterns = append(routePatterns, &routePattern{
+			route.Method(),
+			pattern,
+			regexp.MustCompile(`^` + expr + `/?$`),
+		})
+	}
+}
+
+// matchRoute finds the route martini dispatches the request to. The
+// router keeps what it matched to itself, so we match again.
+func matchRoute(routes martini.Routes, req *http.Request) (string, map[string]string) {
+	routePatternsOnce.Do(func() { compileRoutes(routes) })
+
+	for _, route := range routePatterns {
+		if route.method != req.Method && route.method != "*" && !(req.Method == "HEAD" && route.method == "GET") {
+			continue
+		}
+		matches := route.regex.FindStringSubmatch(req.URL.Path)
+		if matches == nil {
+			continue
+		}
+		params := map[string]string{}
+		for i, name := range route.regex.SubexpNames() {
+			if name != "" {
+				params[name] = matches[i]
+			}
+		}
+		return route.pattern, params
+	}
+	return "", nil
+}
+
+// accessLog logs every request and feeds the HTTP metrics. It goes first so
+// that it sees the status of requests that panicked as Recovery wrote it.
+func accessLog(c martini.Context, res http.ResponseWriter, req *http.Request, routes martini.Routes) {
+	start := time.Now()
+	c.Next()
+	latency := time.Since(start)
+
+	rw := res.(martini.ResponseWriter)
+	status := rw.Status()
+	if status == 0 {
+		status = 200
+	}
+	route, params := matchRoute(routes, req)
+
+	httpRequests.Add(labels("method", req.Method, "route", route, "status", strconv.Itoa(status)), 1)
+	httpDuration.Observe(labels("method", req.Method, "route", route), latency.Seconds())
+
+	if accessLogWriter == nil {
+		return
+	}
+	line, err := json.Marshal(&AccessLog{
+		Time:    start,
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Route:   route,
+		Slot:    params["slot"],
+		AdId:    params["id"],
+		Status:  status,
+		Latency: latency.Seconds(),
+		Bytes:   rw.Size(),
+	})
+	if err != nil {
+		return
+	}
+	accessLogMutex.Lock()
+	accessLogWriter.Write(append(line, '\n'))
+	accessLogMutex.Unlock()
+}
+
+// newClassic is martini.Classic with accessLog in place of its text logger.
+func newClassic() *martini.ClassicMartini {
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Use(accessLog)
+	m.Use(martini.Recovery())
+	m.Use(martini.Static("public"))
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
+	return &martini.ClassicMartini{Martini: m, Router: r}
+}
@@ -1,20 +1,15 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
-	"syscall"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
-	redis "gopkg.in/redis.v3"
 )
 
 type Ad struct {
@@ -25,21 +20,54 @@ type Ad struct {
 	Advertiser  string `json:"advertiser"`
 	Destination string `json:"destination"`
 	Impressions int    `json:"impressions"`
+	AssetHash   string `json:"-"`
+	Status      string `json:"status"`
+
+	Weight             int `json:"weight"`
+	ImpressionCap      int `json:"impression_cap"`
+	DailyImpressionCap int `json:"daily_impression_cap"`
+	DailyImpressions   int `json:"daily_impressions"`
+
+	Targeting Targeting  `json:"targeting"`
+	Media     *MediaInfo `json:"media,omitempty"`
 }
 
+const (
+	AdStatusActive = "active"
+	AdStatusPaused = "paused"
+)
+
 type AdWithEndpoints struct {
 	Ad
 	Asset    string `json:"asset"`
 	Redirect string `json:"redirect"`
 	Counter  string `json:"counter"`
+
+	// token is the serve the redirect and counter URLs carry, "" when they
+	// carry none.
+	token string
 }
 
 type ClickLog struct {
-	AdId   string `json:"ad_id"`
-	User   string `json:"user"`
-	Agent  string `json:"agent"`
-	Gender string `json:"gender"`
-	Age    int    `json:"age"`
+	AdId   string    `json:"ad_id"`
+	User   string    `json:"user"`
+	Agent  string    `json:"agent"`
+	Gender string    `json:"gender"`
+	Age    int       `json:"age"`
+	At     time.Time `json:"at"`
+
+	// Invalid is why the click is not billed, "" for a billable one.
+	Invalid string `json:"invalid,omitempty"`
+
+	// Kind is "" for a click and "conversion" for a conversion logged
+	// against the click named by ClickId.
+	Kind    string `json:"kind,omitempty"`
+	ClickId string `json:"click_id,omitempty"`
+
+	// Slot and Advertiser are implied by where a click is logged and only
+	// kept with clicks saved for conversion tracking.
+	Slot       string `json:"slot,omitempty"`
+	Advertiser string `json:"advertiser,omitempty"`
 }
 
 type Report struct {
@@ -47,21 +75,62 @@ type Report struct {
 	Clicks      int              `json:"clicks"`
 	Impressions int              `json:"impressions"`
 	Breakdown   *BreakdownReport `json:"breakdown,omitempty"`
+
+	InvalidClicks *InvalidClickReport `json:"invalid_clicks,omitempty"`
+
+	Conversions         int              `json:"conversions"`
+	ConversionRate      float64          `json:"conversion_rate"`
+	ConversionBreakdown *BreakdownReport `json:"conversion_breakdown,omitempty"`
 }
 
+type InvalidClickReport struct {
+	Total   int            `json:"total"`
+	Reasons map[string]int `json:"reasons"`
+}
+
+// BreakdownReport counts clicks by viewer. Agents keys on the raw
+// User-Agent; Devices, OS and Browsers on what parseUserAgent makes of it.
 type BreakdownReport struct {
 	Gender      map[string]int `json:"gender"`
 	Agents      map[string]int `json:"agents"`
 	Generations map[string]int `json:"generations"`
+	Devices     map[string]int `json:"devices"`
+	OS          map[string]int `json:"os"`
+	Browsers    map[string]int `json:"browsers"`
 }
 
-var rd *redis.Client
+var store AdStore
+var storeKind string
+var assets *AssetStore
+var uploads *UploadStore
+var clicks ClickStore
+var clickStoreKind string
 
 func init() {
-	rd = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   0,
-	})
+	storeKind = getEnv("ISU4_STORE", "redis")
+	store = newMeteredStore(newAdStore(storeKind), storeKind)
+	assets = newAssetStore(getEnv("ISU4_ASSET_DIR", getDir("assets")))
+	uploads = newUploadStore(getEnv("ISU4_UPLOAD_DIR", getDir("uploads")))
+	// Click logs on local disk would give every node sharing a Redis
+	// numbers of its own.
+	clickStoreKind = "file"
+	if storeKind == "redis" {
+		clickStoreKind = "redis"
+	}
+	clickStoreKind = getEnv("ISU4_CLICK_STORE", clickStoreKind)
+	clicks = newMeteredClickStore(newClickStore(clickStoreKind), clickStoreKind)
+	if storeKind == "redis" {
+		nodes = newNodeBus(redisOptions())
+	}
+}
+
+func getEnv(key string, def string) string {
+	v := os.Getenv(key)
+	if len(v) == 0 {
+		return def
+	}
+
+	return v
 }
 
 func getDir(name string) string {
@@ -100,209 +169,211 @@ func advertiserId(req *http.Request) string {
 	return req.Header.Get("X-Advertiser-Id")
 }
 
-func adKey(slot string, id string) string {
-	return "isu4:ad:" + slot + "-" + id
-}
-
-func assetKey(slot string, id string) string {
-	return "isu4:asset:" + slot + "-" + id
-}
-
-func advertiserKey(id string) string {
-	return "isu4:advertiser:" + id
-}
-
-func slotKey(slot string) string {
-	return "isu4:slot:" + slot
-}
+func nextAd(req *http.Request, slot string, viewer *Identity) *AdWithEndpoints {
+	ids := store.SlotAds(slot)
+	ads, err := store.GetAds(slot, ids)
+	if err != nil {
+		log.Print("next ad: ", err)
+	}
+	candidates := []*Ad{}
+	for i, ad := range ads {
+		// Only an ad the store says is gone is taken out of the slot; one
+		// that could not be read is merely skipped this time. Pausing takes
+		// an ad out itself, and one seen paused here may be resumed by now.
+		if ad == nil && err == nil {
+			store.RemoveSlotAd(slot, ids[i])
+			rotation.Forget(slot, ids[i])
+			continue
+		}
+		if ad != nil && ad.Status != AdStatusPaused && ad.HasBudget() {
+			candidates = append(candidates, ad)
+		}
+	}
+	candidates = frequencyCap.Filter(viewer, slot, candidates)
 
-func nextAdId() string {
-	id, _ := rd.Incr("isu4:ad-next").Result()
-	return strconv.FormatInt(id, 10)
+	ad := rotation.Pick(slot, selectTargeted(candidates, viewerOf(req, viewer)))
+	if ad == nil {
+		return nil
+	}
+	return withEndpoints(req, ad, newServeToken(ad.Slot, ad.Id, time.Now()))
 }
 
-func nextAd(req *http.Request, slot string) *AdWithEndpoints {
-	key := slotKey(slot)
-	id, _ := rd.RPopLPush(key, key).Result()
-	if id == "" {
-		return nil
+// withEndpoints adds the URLs of the ad. Only nextAd starts serves, so
+// only its ads get a token minted for them.
+func withEndpoints(req *http.Request, ad *Ad, token string) *AdWithEndpoints {
+	path_base := "/slots/" + ad.Slot + "/ads/" + ad.Id
+	query := ""
+	if token != "" {
+		query = "?t=" + token
 	}
-	ad := getAd(req, slot, id)
-	if ad != nil {
-		return ad
-	} else {
-		rd.LRem(key, 0, id).Result()
-		return nextAd(req, slot)
+	return &AdWithEndpoints{
+		*ad,
+		urlFor(req, path_base+"/asset"),
+		urlFor(req, path_base+"/redirect"+query),
+		urlFor(req, path_base+"/count"+query),
+		token,
 	}
 }
 
 func getAd(req *http.Request, slot string, id string) *AdWithEndpoints {
-	key := adKey(slot, id)
-	m, _ := rd.HGetAllMap(key).Result()
-
-	if m == nil {
-		return nil
-	}
-	if _, exists := m["id"]; !exists {
+	ad := store.GetAd(slot, id)
+	if ad == nil {
 		return nil
 	}
-
-	imp, _ := strconv.Atoi(m["impressions"])
-	path_base := "/slots/" + slot + "/ads/" + id
-	var ad *AdWithEndpoints
-	ad = &AdWithEndpoints{
-		Ad{
-			m["slot"],
-			m["id"],
-			m["title"],
-			m["type"],
-			m["advertiser"],
-			m["destination"],
-			imp,
-		},
-		urlFor(req, path_base+"/asset"),
-		urlFor(req, path_base+"/redirect"),
-		urlFor(req, path_base+"/count"),
-	}
-	return ad
+	return withEndpoints(req, ad, "")
 }
 
+// decodeUserKey reads the viewer a click was logged with, "unknown" and -1
+// when it is empty or malformed.
 func decodeUserKey(id string) (string, int) {
-	if id == "" {
+	gender, age, ok := parseUserKey(id)
+	if !ok {
 		return "unknown", -1
 	}
-	splitted := strings.Split(id, "/")
-	gender := "male"
-	if splitted[0] == "0" {
-		gender = "female"
-	}
-	age, _ := strconv.Atoi(splitted[1])
-
 	return gender, age
 }
 
-func getLogPath(advrId string) string {
-	dir := getDir("log")
-	splitted := strings.Split(advrId, "/")
-	return dir + "/" + splitted[len(splitted)-1]
-}
+func routePostAd(r render.Render, req *http.Request, params martini.Params) {
+	slot := params["slot"]
+
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(404)
+		return
+	}
 
-func getLog(id string) map[string][]ClickLog {
-	path := getLogPath(id)
-	result := map[string][]ClickLog{}
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return result
+	if err := req.ParseMultipartForm(100000); err != nil {
+		r.JSON(400, map[string]string{"error": "invalid_form"})
+		return
+	}
+	defer req.MultipartForm.RemoveAll()
+	if len(req.MultipartForm.File["asset"]) == 0 {
+		r.JSON(400, &ErrorResponse{Error: "missing_asset", Field: "asset"})
+		return
 	}
+	asset := req.MultipartForm.File["asset"][0]
 
-	f, err := os.Open(path)
+	f, err := asset.Open()
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
 
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
-	if err != nil {
-		panic(err)
+	content_type := req.Form.Get("type")
+	if content_type == "" && len(asset.Header["Content-Type"]) > 0 && asset.Header["Content-Type"][0] != "application/octet-stream" {
+		content_type = asset.Header["Content-Type"][0]
 	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimRight(line, "\n")
-		sp := strings.Split(line, "\t")
-		ad_id := sp[0]
-		user := sp[1]
-		agent := sp[2]
-		if agent == "" {
-			agent = "unknown"
-		}
-		gender, age := decodeUserKey(sp[1])
-		if result[ad_id] == nil {
-			result[ad_id] = []ClickLog{}
-		}
-		data := ClickLog{ad_id, user, agent, gender, age}
-		result[ad_id] = append(result[ad_id], data)
+	ad, status, e := createAd(slot, advrId, req.Form, f, asset.Size, content_type)
+	if e != nil {
+		r.JSON(status, e)
+		return
 	}
 
-	return result
+	r.JSON(200, getAd(req, slot, ad.Id))
 }
 
-func routePostAd(r render.Render, req *http.Request, params martini.Params) {
-	slot := params["slot"]
-
-	advrId := advertiserId(req)
-	if advrId == "" {
-		r.Status(404)
-		return
+// createAd probes the creative, checks it and the ad fields in form against
+// the slot, stores it and publishes the ad. declared is the media type the
+// client claimed, "" if none. A rejected ad leaves nothing behind; the
+// status and body to answer with are returned instead.
+func createAd(slot string, advrId string, form url.Values, f io.ReadSeeker, size int64, declared string) (*Ad, int, *ErrorResponse) {
+	media, err := probeMedia(f, size)
+	if err != nil {
+		return nil, 415, &ErrorResponse{Error: "unsupported_type", Message: err.Error(), Field: "asset", Allowed: supportedTypes}
+	}
+	if declared != "" && declared != media.Type {
+		return nil, 400, &ErrorResponse{Error: "type_mismatch", Message: "asset is " + media.Type, Field: "type", Allowed: media.Type}
 	}
 
-	req.ParseMultipartForm(100000)
-	asset := req.MultipartForm.File["asset"][0]
-	id := nextAdId()
-	key := adKey(slot, id)
+	if info := store.GetSlot(slot); info != nil {
+		if e := info.checkAsset(media); e != nil {
+			return nil, 400, e
+		}
+	}
 
-	content_type := ""
-	if len(req.Form["type"]) > 0 {
-		content_type = req.Form["type"][0]
+	ad := &Ad{
+		Slot:        slot,
+		Title:       form.Get("title"),
+		Type:        media.Type,
+		Advertiser:  advrId,
+		Destination: form.Get("destination"),
+		Status:      AdStatusActive,
+		Weight:      1,
+		Media:       media,
 	}
-	if content_type == "" && len(asset.Header["Content-Type"]) > 0 {
-		content_type = asset.Header["Content-Type"][0]
+	if code := parseDelivery(form, ad); code != "" {
+		return nil, 400, &ErrorResponse{Error: code}
 	}
-	if content_type == "" {
-		content_type = "video/mp4"
+	if code := parseTargeting(form, &ad.Targeting); code != "" {
+		return nil, 400, &ErrorResponse{Error: code}
 	}
 
-	title := ""
-	if a := req.Form["title"]; a != nil {
-		title = a[0]
+	if _, err = f.Seek(0, 0); err != nil {
+		panic(err)
 	}
-	destination := ""
-	if a := req.Form["destination"]; a != nil {
-		destination = a[0]
+	ad.AssetHash, _, err = assets.Put(f)
+	if err != nil {
+		panic(err)
 	}
 
-	rd.HMSet(key,
-		"slot", slot,
-		"id", id,
-		"title", title,
-		"type", content_type,
-		"advertiser", advrId,
-		"destination", destination,
-		"impressions", "0",
-	)
+	ad.Id = store.NextAdId()
+	store.SaveAd(ad)
+	store.PushSlotAd(slot, ad.Id)
+	store.AddAdvertiserAd(advrId, slot, ad.Id)
 
-	f, _ := asset.Open()
-	defer f.Close()
-	buf := bytes.NewBuffer(nil)
-	io.Copy(buf, f)
-	asset_data := string(buf.Bytes())
-
-	rd.Set(assetKey(slot, id), asset_data, 0)
-	rd.RPush(slotKey(slot), id)
-	rd.SAdd(advertiserKey(advrId), key)
-
-	r.JSON(200, getAd(req, slot, id))
+	return ad, 200, nil
 }
 
-func routeGetAd(r render.Render, req *http.Request, params martini.Params) {
+func routeGetAd(r render.Render, res http.ResponseWriter, req *http.Request, params martini.Params) {
 	slot := params["slot"]
-	ad := nextAd(req, slot)
-	if ad != nil {
-		r.Redirect("/slots/" + slot + "/ads/" + ad.Id)
-	} else {
+	format := adFormat(req)
+	if format == "" {
+		r.JSON(400, &ErrorResponse{Error: "invalid_format", Field: "format", Allowed: []string{"redirect", "json", "vast"}})
+		return
+	}
+	callback := req.URL.Query().Get("callback")
+	if callback != "" && !jsonpCallbackPattern.MatchString(callback) {
+		r.JSON(400, &ErrorResponse{Error: "invalid_callback", Field: "callback"})
+		return
+	}
+
+	viewer := identify(req)
+	trackViewer(res, req, viewer)
+	ad := nextAd(req, slot, viewer)
+	switch {
+	case format == "vast":
+		writeVast(res, ad)
+	case format == "json" && callback != "":
+		if ad != nil {
+			writeJSONP(res, callback, ad)
+		} else {
+			writeJSONP(res, callback, map[string]string{"error": "not_found"})
+		}
+	case ad == nil:
 		r.JSON(404, map[string]string{"error": "not_found"})
+	case format == "json":
+		r.JSON(200, ad)
+	default:
+		r.Redirect("/slots/" + slot + "/ads/" + ad.Id + "?t=" + ad.token)
 	}
 }
 
 func routeGetAdWithId(r render.Render, req *http.Request, params martini.Params) {
 	slot := params["slot"]
 	id := params["id"]
-	ad := getAd(req, slot, id)
-	if ad != nil {
-		r.JSON(200, ad)
-	} else {
+	ad := store.GetAd(slot, id)
+	if ad == nil {
 		r.JSON(404, map[string]string{"error": "not_found"})
+		return
 	}
+	// The token of a serve GET /slots/:slot/ad started is handed on; this
+	// route never mints one.
+	token := req.URL.Query().Get("t")
+	if verifyServeToken(token, slot, id, time.Now()) == "" {
+		token = ""
+	}
+	r.JSON(200, withEndpoints(req, ad, token))
 }
 
 func routeGetAdAsset(r render.Render, res http.ResponseWriter, req *http.Request, params martini.Params) {
@@ -318,68 +389,57 @@ func routeGetAdAsset(r render.Render, res http.ResponseWriter, req *http.Request
 		content_type = ad.Type
 	}
 
-	res.Header().Set("Content-Type", content_type)
-	data, _ := rd.Get(assetKey(slot, id)).Result()
-
-	range_str := req.Header.Get("Range")
-	if range_str == "" {
-		r.Data(200, []byte(data))
-		return
-	}
-
-	re := regexp.MustCompile("^bytes=(\\d*)-(\\d*)$")
-	m := re.FindAllStringSubmatch(range_str, -1)
-
-	if m == nil {
-		r.Status(416)
-		return
-	}
-
-	head_str := m[0][1]
-	tail_str := m[0][2]
-
-	if head_str == "" && tail_str == "" {
-		r.Status(416)
+	f, err := assets.Open(ad.AssetHash)
+	if err != nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
 		return
 	}
-
-	head := 0
-	tail := 0
-
-	if head_str != "" {
-		head, _ = strconv.Atoi(head_str)
-	}
-	if tail_str != "" {
-		tail, _ = strconv.Atoi(tail_str)
-	} else {
-		tail = len(data) - 1
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
 	}
 
-	if head < 0 || head >= len(data) || tail < 0 {
-		r.Status(416)
-		return
+	if range_str := req.Header.Get("Range"); range_str != "" {
+		if coalesced := coalesceRange(range_str, fi.Size()); coalesced != "" {
+			req.Header.Set("Range", coalesced)
+		} else {
+			req.Header.Del("Range")
+		}
 	}
 
-	range_data := data[head:(tail + 1)]
-	content_range := fmt.Sprintf("bytes %d-%d/%d", head, tail, len(data))
-	res.Header().Set("Content-Range", content_range)
-	res.Header().Set("Content-Length", strconv.Itoa(len(range_data)))
-
-	r.Data(206, []byte(range_data))
+	res.Header().Set("Content-Type", content_type)
+	res.Header().Set("ETag", `"`+ad.AssetHash+`"`)
+	http.ServeContent(res, req, "", fi.ModTime(), f)
 }
 
-func routeGetAdCount(r render.Render, params martini.Params) {
+func routeGetAdCount(r render.Render, req *http.Request, params martini.Params) {
 	slot := params["slot"]
 	id := params["id"]
-	key := adKey(slot, id)
 
-	exists, _ := rd.Exists(key).Result()
-	if !exists {
+	advrId := store.AdAdvertiser(slot, id)
+	if advrId == "" {
 		r.JSON(404, map[string]string{"error": "not_found"})
 		return
 	}
+	switch claimServe(req, "count", slot, id) {
+	case InvalidClickToken:
+		r.JSON(403, map[string]string{"error": "invalid_token"})
+		return
+	case InvalidClickReplayed:
+		r.JSON(409, map[string]string{"error": "already_counted"})
+		return
+	}
 
-	rd.HIncrBy(key, "impressions", 1).Result()
+	now := time.Now()
+	total, err := store.IncrImpressions(slot, id, now)
+	if err != nil {
+		panic(err)
+	}
+	reportBroker.Publish(advrId, &ReportDelta{Slot: slot, AdId: id, Impressions: 1, Total: total, At: now})
+	viewer := identify(req)
+	frequencyCap.Record(viewer, slot, id)
+	clickFilter.RecordImpression(viewer, slot, id)
 	r.Status(204)
 }
 
@@ -393,37 +453,38 @@ func routeGetAdRedirect(req *http.Request, r render.Render, params martini.Param
 		return
 	}
 
-	isuad := ""
-	cookie, err := req.Cookie("isuad")
-	if err != nil {
-		if err != http.ErrNoCookie {
-			panic(err)
-		}
-	} else {
-		isuad = cookie.Value
-	}
+	viewer := identify(req)
 	ua := req.Header.Get("User-Agent")
 
-	path := getLogPath(ad.Advertiser)
-
-	var f *os.File
-	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	click := &ClickLog{
+		AdId:       ad.Id,
+		User:       viewer.UserKey(),
+		Agent:      ua,
+		At:         time.Now(),
+		ClickId:    newClickId(),
+		Slot:       slot,
+		Advertiser: ad.Advertiser,
+	}
+	// Flagged clicks are redirected all the same; nothing tells a bot apart.
+	click.Invalid = clickFilter.Check(req, viewer, &ad.Ad)
+	if reason := claimServe(req, "click", slot, id); reason != "" {
+		click.Invalid = reason
+	}
+	start := time.Now()
+	total, err := clicks.Record(ad.Advertiser, click)
+	clickLogDuration.Since("", start)
 	if err != nil {
 		panic(err)
 	}
-
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
-	if err != nil {
-		panic(err)
+	trackClick(click)
+	if click.Invalid == "" {
+		reportBroker.Publish(ad.Advertiser, &ReportDelta{Slot: slot, AdId: id, Clicks: 1, Total: total, At: click.At})
 	}
 
-	fmt.Fprintf(f, "%s\t%s\t%s\n", ad.Id, isuad, ua)
-	f.Close()
-
-	r.Redirect(ad.Destination)
+	r.Redirect(withClickId(ad.Destination, click.ClickId))
 }
 
-func routeGetReport(req *http.Request, r render.Render) {
+func routeGetReport(req *http.Request, res http.ResponseWriter, r render.Render) {
 	advrId := advertiserId(req)
 
 	if advrId == "" {
@@ -431,42 +492,10 @@ func routeGetReport(req *http.Request, r render.Render) {
 		return
 	}
 
-	report := map[string]*Report{}
-	adKeys, _ := rd.SMembers(advertiserKey(advrId)).Result()
-	for _, adKey := range adKeys {
-		ad, _ := rd.HGetAllMap(adKey).Result()
-		if ad == nil {
-			continue
-		}
-
-		imp, _ := strconv.Atoi(ad["impressions"])
-		data := &Report{
-			&Ad{
-				ad["slot"],
-				ad["id"],
-				ad["title"],
-				ad["type"],
-				ad["advertiser"],
-				ad["destination"],
-				imp,
-			},
-			0,
-			imp,
-			nil,
-		}
-		report[ad["id"]] = data
-	}
-
-	for adId, clicks := range getLog(advrId) {
-		if _, exists := report[adId]; !exists {
-			report[adId] = &Report{}
-		}
-		report[adId].Clicks = len(clicks)
-	}
-	r.JSON(200, report)
+	writeReports(req, res, r, advrId, false)
 }
 
-func routeGetFinalReport(req *http.Request, r render.Render) {
+func routeGetFinalReport(req *http.Request, res http.ResponseWriter, r render.Render) {
 	advrId := advertiserId(req)
 
 	if advrId == "" {
@@ -474,94 +503,76 @@ func routeGetFinalReport(req *http.Request, r render.Render) {
 		return
 	}
 
-	reports := map[string]*Report{}
-	adKeys, _ := rd.SMembers(advertiserKey(advrId)).Result()
-	for _, adKey := range adKeys {
-		ad, _ := rd.HGetAllMap(adKey).Result()
-		if ad == nil {
-			continue
-		}
-
-		imp, _ := strconv.Atoi(ad["impressions"])
-		data := &Report{
-			&Ad{
-				ad["slot"],
-				ad["id"],
-				ad["title"],
-				ad["type"],
-				ad["advertiser"],
-				ad["destination"],
-				imp,
-			},
-			0,
-			imp,
-			nil,
-		}
-		reports[ad["id"]] = data
-	}
-
-	logs := getLog(advrId)
-
-	for adId, report := range reports {
-		log, exists := logs[adId]
-		if exists {
-			report.Clicks = len(log)
-		}
-
-		breakdown := &BreakdownReport{
-			map[string]int{},
-			map[string]int{},
-			map[string]int{},
-		}
-		for i := range log {
-			click := log[i]
-			incr_map(&breakdown.Gender, click.Gender)
-			incr_map(&breakdown.Agents, click.Agent)
-			generation := "unknown"
-			if click.Age != -1 {
-				generation = strconv.Itoa(click.Age / 10)
-			}
-			incr_map(&breakdown.Generations, generation)
-		}
-		report.Breakdown = breakdown
-		reports[adId] = report
-	}
-
-	r.JSON(200, reports)
+	writeReports(req, res, r, advrId, true)
 }
 
 func routePostInitialize() (int, string) {
-	keys, _ := rd.Keys("isu4:*").Result()
-	for i := range keys {
-		key := keys[i]
-		rd.Del(key)
+	store.Flush()
+	clearShared()
+	resetNode()
+	if nodes != nil {
+		if err := nodes.resetOthers(); err != nil {
+			log.Print("initialize: ", err)
+			return 500, err.Error()
+		}
 	}
-	path := getDir("log")
-	os.RemoveAll(path)
 
 	return 200, "OK"
 }
 
 func main() {
-	m := martini.Classic()
+	m := newClassic()
 
 	m.Use(martini.Static("../public"))
 	m.Use(render.Renderer(render.Options{
 		Layout: "layout",
 	}))
 
+	m.Post("/slots", authAdvertiser, routePostSlot)
+	m.Get("/slots", routeGetSlots)
+	m.Get("/slots/:slot", routeGetSlot)
+	m.Put("/slots/:slot", authAdvertiser, routePutSlot)
 	m.Group("/slots/:slot", func(r martini.Router) {
-		m.Post("/ads", routePostAd)
+		m.Post("/ads", authAdvertiser, routePostAd)
+		m.Post("/uploads", authAdvertiser, routePostUpload)
+		m.Head("/uploads/:upload", authAdvertiser, routeGetUpload)
+		m.Get("/uploads/:upload", authAdvertiser, routeGetUpload)
+		m.Patch("/uploads/:upload", authAdvertiser, routePatchUpload)
+		m.Delete("/uploads/:upload", authAdvertiser, routeDeleteUpload)
 		m.Get("/ad", routeGetAd)
 		m.Get("/ads/:id", routeGetAdWithId)
+		m.Put("/ads/:id", authAdvertiser, routePutAd)
+		m.Patch("/ads/:id", authAdvertiser, routePatchAd)
+		m.Delete("/ads/:id", authAdvertiser, routeDeleteAd)
+		m.Post("/ads/:id/pause", authAdvertiser, routePostAdPause)
+		m.Post("/ads/:id/resume", authAdvertiser, routePostAdResume)
 		m.Get("/ads/:id/asset", routeGetAdAsset)
 		m.Post("/ads/:id/count", routeGetAdCount)
+		m.Get("/ads/:id/count", routeGetAdCount)
 		m.Get("/ads/:id/redirect", routeGetAdRedirect)
 	})
 	m.Group("/me", func(r martini.Router) {
 		m.Get("/report", routeGetReport)
 		m.Get("/final_report", routeGetFinalReport)
+		m.Get("/report/timeseries", routeGetReportTimeseries)
+	}, authAdvertiser)
+	m.Get("/me/report/stream", authAdvertiserStream, routeGetReportStream)
+	m.Group("/viewer", func(r martini.Router) {
+		m.Get("/profile", routeGetViewerProfile)
+		m.Put("/profile", routePutViewerProfile)
+		m.Delete("/profile", routeDeleteViewerProfile)
+		m.Post("/opt-out", routePostViewerOptOut)
+		m.Delete("/opt-out", routeDeleteViewerOptOut)
 	})
+	m.Get("/conversions/pixel", routeGetConversionPixel)
+	m.Post("/conversions", authAdvertiser, routePostConversion)
 	m.Post("/initialize", routePostInitialize)
-	http.ListenAndServe(":8080", m)
+	m.Group("/admin", func(r martini.Router) {
+		m.Get("/snapshots", routeGetSnapshots)
+		m.Post("/snapshots", routePostSnapshot)
+		m.Post("/snapshots/:name/restore", routePostSnapshotRestore)
+		m.Delete("/snapshots/:name", routeDeleteSnapshot)
+	}, authAdmin)
+	m.Get("/metrics", authAdmin, routeGetMetrics)
+	serve(m)
 }
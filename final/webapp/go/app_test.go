@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/martini-contrib/render"
+)
+
+// testRender records what a handler answered.
+type testRender struct {
+	render.Render
+
+	status   int
+	body     interface{}
+	location string
+}
+
+func (r *testRender) JSON(status int, v interface{}) {
+	r.status, r.body = status, v
+}
+
+func (r *testRender) Status(status int) {
+	r.status = status
+}
+
+func (r *testRender) Redirect(location string, status ...int) {
+	r.status, r.location = 302, location
+}
+
+// errorCode is the error a handler answered with, "" for none.
+func (r *testRender) errorCode() string {
+	switch body := r.body.(type) {
+	case map[string]string:
+		return body["error"]
+	case *ErrorResponse:
+		return body.Error
+	}
+	return ""
+}
+
+// useTestStores points the app at an empty memory store, with assets,
+// uploads and clicks in a scratch directory. The returned func puts
+// everything back.
+func useTestStores(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "isu4-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedStore, savedKind := store, storeKind
+	savedAssets, savedUploads, savedClicks, savedClicksKind := assets, uploads, clicks, clickStoreKind
+	savedNodes, savedRotation := nodes, rotation
+
+	store, storeKind = newMemoryStore(), "memory"
+	assets = newAssetStore(filepath.Join(dir, "assets"))
+	uploads = newUploadStore(filepath.Join(dir, "uploads"))
+	clicks, clickStoreKind = newFileClickStore(filepath.Join(dir, "log")), "file"
+	nodes = nil
+	rotation = newRotation()
+
+	return func() {
+		store, storeKind = savedStore, savedKind
+		assets, uploads, clicks, clickStoreKind = savedAssets, savedUploads, savedClicks, savedClicksKind
+		nodes, rotation = savedNodes, savedRotation
+		os.RemoveAll(dir)
+	}
+}
+
+// failingStore fails every read of the ads, as a Redis timing out would.
+type failingStore struct {
+	AdStore
+}
+
+func (s failingStore) GetAds(slot string, ids []string) ([]*Ad, error) {
+	return make([]*Ad, len(ids)), errors.New("read timed out")
+}
+
+func TestNextAdKeepsAdsItCouldNotRead(t *testing.T) {
+	defer useTestStores(t)()
+	ad := &Ad{Slot: "s", Id: store.NextAdId(), Advertiser: "a", Status: AdStatusActive, Weight: 1}
+	store.SaveAd(ad)
+	store.PushSlotAd("s", ad.Id)
+
+	store = failingStore{store}
+	req, _ := http.NewRequest("GET", "http://localhost/slots/s/ad", nil)
+	if got := nextAd(req, "s", &Identity{}); got != nil {
+		t.Errorf("served %+v", got)
+	}
+	if ids := store.SlotAds("s"); len(ids) != 1 || ids[0] != ad.Id {
+		t.Errorf("slot ads: got %v", ids)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AssetStore keeps ad creatives on disk, named by the SHA-256 of their
+// content, so the same video uploaded for many ads is stored once.
+type AssetStore struct {
+	dir string
+}
+
+func newAssetStore(dir string) *AssetStore {
+	os.MkdirAll(dir, 0755)
+	return &AssetStore{dir}
+}
+
+func (s *AssetStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Put streams r into the store and returns the content hash and size.
+func (s *AssetStore) Put(r io.Reader) (string, int64, error) {
+	tmp, err := ioutil.TempFile(s.dir, "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, size, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (s *AssetStore) Open(hash string) (*os.File, error) {
+	if len(hash) < 2 {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(s.path(hash))
+}
+
+// Snapshot links every creative into dir, copying where links cannot be
+// made. Creatives never change once stored, so links are as good as copies.
+func (s *AssetStore) Snapshot(dir string) error {
+	return linkTree(dir, s.dir, func(name string) bool {
+		return !strings.HasPrefix(name, "upload-")
+	})
+}
+
+// Restore replaces the stored creatives with those of a snapshot.
+func (s *AssetStore) Restore(dir string) error {
+	if err := s.Clear(); err != nil {
+		return err
+	}
+	return linkTree(s.dir, dir, func(string) bool { return true })
+}
+
+func (s *AssetStore) Clear() error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, 0755)
+}
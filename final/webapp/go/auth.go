@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Advertiser requests are signed with a per-advertiser key:
+//
+//	X-Advertiser-Id:        42
+//	X-Advertiser-Timestamp: 1413625200
+//	X-Advertiser-Nonce:     anything, to tell apart requests signed in the same second
+//	X-Advertiser-Signature: hex(HMAC-SHA256(key, METHOD "\n" PATH "\n" QUERY "\n"
+//	                            TIMESTAMP "\n" NONCE "\n" hex(SHA-256(BODY))))
+//
+// QUERY is the raw query string as sent, without the "?". A signature is
+// accepted once: a request sent again, by the client or anyone who saw it,
+// is refused. The report stream alone takes a signature again while its
+// timestamp holds, for EventSource to reconnect with.
+//
+// The key of an advertiser is derived from ISU4_ADVERTISER_SECRET, so
+// accounts need no storage: whoever holds the secret can hand an advertiser
+// its key (see advertiserKeyFor). Without the secret the app falls back to
+// trusting X-Advertiser-Id as before.
+var advertiserSecret = getEnv("ISU4_ADVERTISER_SECRET", "")
+
+const signatureMaxSkew = 5 * time.Minute
+
+// signedBodyInMemory is how much of a body is kept in memory while it is
+// hashed. Larger ones, such as creatives, go to a temporary file.
+const signedBodyInMemory = 1 << 20
+
+func init() {
+	if advertiserSecret == "" {
+		log.Print("ISU4_ADVERTISER_SECRET is not set; trusting X-Advertiser-Id without signatures")
+	}
+	if adminToken == "" {
+		log.Print("ISU4_ADMIN_TOKEN is not set; /admin and /metrics are disabled")
+	}
+}
+
+func advertiserKeyFor(advrId string) []byte {
+	mac := hmac.New(sha256.New, []byte(advertiserSecret))
+	mac.Write([]byte("advertiser:" + advrId))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func requestSignature(key []byte, req *http.Request, timestamp string, nonce string, bodyDigest string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(req.Method + "\n" + req.URL.Path + "\n" + req.URL.RawQuery + "\n" +
+		timestamp + "\n" + nonce + "\n" + bodyDigest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// spoolBody hashes the request body and puts back a copy for handlers to
+// read. The returned func removes what it spooled to disk.
+func spoolBody(req *http.Request) (string, func(), error) {
+	hash := sha256.New()
+	if req.Body == nil {
+		return hex.EncodeToString(hash.Sum(nil)), func() {}, nil
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(io.MultiWriter(buf, hash), req.Body, signedBodyInMemory+1)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	if n <= signedBodyInMemory {
+		req.Body = ioutil.NopCloser(buf)
+		return hex.EncodeToString(hash.Sum(nil)), func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "isu4-body-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		if _, err = io.Copy(io.MultiWriter(tmp, hash), req.Body); err == nil {
+			_, err = tmp.Seek(0, 0)
+		}
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	req.Body = tmp
+	return hex.EncodeToString(hash.Sum(nil)), cleanup, nil
+}
+
+// verifyAdvertiser reports whether the request carries a valid, fresh
+// signature for the advertiser it names, over a body that hashes to
+// bodyDigest.
+func verifyAdvertiser(req *http.Request, bodyDigest string, now time.Time) bool {
+	advrId := advertiserId(req)
+	timestamp := req.Header.Get("X-Advertiser-Timestamp")
+	signature := req.Header.Get("X-Advertiser-Signature")
+	if advrId == "" || timestamp == "" || signature == "" {
+		return false
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return false
+	}
+
+	nonce := req.Header.Get("X-Advertiser-Nonce")
+	expected := requestSignature(advertiserKeyFor(advrId), req, timestamp, nonce, bodyDigest)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// ISU4_ADMIN_TOKEN guards the admin routes, sent as "Authorization: Bearer
+// TOKEN". Without it they answer 404, as if they were not there: snapshots
+// and metrics are not for anyone who asks.
+var adminToken = getEnv("ISU4_ADMIN_TOKEN", "")
+
+func authAdmin(req *http.Request, r render.Render) {
+	if adminToken == "" {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	if !hmac.Equal([]byte(req.Header.Get("Authorization")), []byte("Bearer "+adminToken)) {
+		r.JSON(401, map[string]string{"error": "unauthorized"})
+	}
+}
+
+// authAdvertiser guards advertiser routes. Handlers after it can rely on
+// advertiserId(req) naming the advertiser who signed the request.
+func authAdvertiser(c martini.Context, req *http.Request, r render.Render) {
+	checkAdvertiser(c, req, r, true)
+}
+
+// authAdvertiserStream guards the report stream, which an EventSource
+// reconnects to with the very request it made first. Its signature is not
+// claimed, so that it can be sent again for signatureMaxSkew; a stream
+// only reads.
+func authAdvertiserStream(c martini.Context, req *http.Request, r render.Render) {
+	checkAdvertiser(c, req, r, false)
+}
+
+func checkAdvertiser(c martini.Context, req *http.Request, r render.Render, once bool) {
+	if advertiserSecret == "" {
+		return
+	}
+	bodyDigest, cleanup, err := spoolBody(req)
+	if err != nil {
+		r.JSON(400, map[string]string{"error": "bad_request"})
+		return
+	}
+	defer cleanup()
+
+	if !verifyAdvertiser(req, bodyDigest, time.Now()) {
+		r.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+	// A timestamp passes for signatureMaxSkew either side of now, so that
+	// is how long a signature has to be remembered.
+	if once && !store.ClaimServe("signature", req.Header.Get("X-Advertiser-Signature"), 2*signatureMaxSkew) {
+		r.JSON(401, map[string]string{"error": "replayed"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Reasons a click is not billed. Flagged clicks stay in the click log with
+// their reason so they can be audited, but only count as invalid clicks.
+const (
+	InvalidClickBot          = "bot"
+	InvalidClickNoImpression = "no_impression"
+	InvalidClickRepeat       = "repeat"
+	InvalidClickToken        = "invalid_token"
+	InvalidClickReplayed     = "replayed"
+)
+
+var botAgentPattern = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|curl|wget|python|java/|go-http-client|libwww|httpclient|headless|phantomjs|facebookexternalhit`)
+
+// ClickFilter decides which clicks are billable. A click is invalid when
+// it comes from a known bot, when the viewer was not served the ad within
+// ImpressionWindow, or when the same viewer or address already clicked the
+// ad within RepeatWindow. A zero window turns that check off.
+//
+// Repeat filtering is off by default: a crowd behind one proxy shares an
+// address, and the benchmarker clicks every ad it is shown.
+type ClickFilter struct {
+	ImpressionWindow time.Duration
+	RepeatWindow     time.Duration
+}
+
+var clickFilter = newClickFilter()
+
+func newClickFilter() *ClickFilter {
+	impression, err := time.ParseDuration(getEnv("ISU4_CLICK_IMPRESSION_WINDOW", "1h"))
+	if err != nil {
+		panic(err)
+	}
+	repeat, err := time.ParseDuration(getEnv("ISU4_CLICK_REPEAT_WINDOW", "0"))
+	if err != nil {
+		panic(err)
+	}
+	return &ClickFilter{impression, repeat}
+}
+
+// viewers lists the keys the viewer is known by: its Identity key when
+// there is one, and the client address.
+func (f *ClickFilter) viewers(viewer *Identity) []string {
+	viewers := []string{}
+	if viewer.Key != "" {
+		viewers = append(viewers, viewer.Key)
+	}
+	return append(viewers, "ip:"+viewer.Address)
+}
+
+// RecordImpression remembers that the viewer was served the ad.
+func (f *ClickFilter) RecordImpression(viewer *Identity, slot string, id string) {
+	if f.ImpressionWindow <= 0 {
+		return
+	}
+	viewers := f.viewers(viewer)
+	store.RecordView("imp:"+viewers[0], slot, id, time.Now(), f.ImpressionWindow)
+}
+
+// Check records the click and returns why it is invalid, or "" for a
+// billable one. Invalid clicks are recorded too, so a burst stays flagged.
+func (f *ClickFilter) Check(req *http.Request, viewer *Identity, ad *Ad) string {
+	now := time.Now()
+	viewers := f.viewers(viewer)
+
+	repeated := false
+	if f.RepeatWindow > 0 {
+		for _, viewer := range viewers {
+			if store.CountViews("click:"+viewer, ad.Slot, ad.Id, now.Add(-f.RepeatWindow)) > 0 {
+				repeated = true
+			}
+			store.RecordView("click:"+viewer, ad.Slot, ad.Id, now, f.RepeatWindow)
+		}
+	}
+
+	switch {
+	case botAgentPattern.MatchString(req.Header.Get("User-Agent")):
+		return InvalidClickBot
+	case f.ImpressionWindow > 0 && store.CountViews("imp:"+viewers[0], ad.Slot, ad.Id, now.Add(-f.ImpressionWindow)) == 0:
+		return InvalidClickNoImpression
+	case repeated:
+		return InvalidClickRepeat
+	}
+	return ""
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ClickStore records redirects and conversions and keeps per-ad aggregates
+// current, so reports never have to walk the individual clicks.
+type ClickStore interface {
+	// Record logs the click and returns how many clicks the ad has had,
+	// or conversions for a conversion, this one included. It returns 0
+	// for an invalid click, which is not counted.
+	Record(advrId string, click *ClickLog) (int, error)
+	// Aggregates returns the totals of every ad, and the parts of
+	// ClickAggregate named in with. A store may fill in more than asked.
+	Aggregates(advrId string, with int) (map[string]*ClickAggregate, error)
+	Clear() error
+	// Reload drops whatever the store cached of the recorded clicks, which
+	// another process replaced.
+	Reload()
+	// Snapshot copies every recorded click into dir; Restore replaces the
+	// recorded clicks with those of such a copy.
+	Snapshot(dir string) error
+	Restore(dir string) error
+}
+
+// What Aggregates returns besides the totals.
+const (
+	AggregateBreakdown = 1 << iota
+	AggregateMinutes
+)
+
+// newClickStore returns the store of the given kind: "file" keeps logs in
+// ISU4_LOG_DIR, which only processes on one host can share; "redis" keeps
+// the aggregates in the Redis the AdStore uses, for any number of hosts.
+func newClickStore(kind string) ClickStore {
+	switch kind {
+	case "file":
+		return newFileClickStore(getEnv("ISU4_LOG_DIR", getDir("log")))
+	case "redis":
+		if storeKind != "redis" {
+			panic("the redis click store needs the redis store")
+		}
+		return newRedisClickStore(redisOptions())
+	}
+	panic("unknown click store: " + kind)
+}
+
+// ClickAggregate sums up the clicks of one ad. Minutes counts clicks per
+// minute, keyed by the unix time the minute starts at; clicks logged before
+// timestamps were recorded only show up in the totals. Invalid clicks are
+// only counted by reason and left out of everything else.
+type ClickAggregate struct {
+	Clicks    int              `json:"clicks"`
+	Breakdown *BreakdownReport `json:"breakdown"`
+	Minutes   map[int64]int    `json:"minutes"`
+	Invalid   map[string]int   `json:"invalid"`
+
+	Conversions         int              `json:"conversions"`
+	ConversionBreakdown *BreakdownReport `json:"conversion_breakdown"`
+}
+
+func newBreakdownReport() *BreakdownReport {
+	return &BreakdownReport{
+		map[string]int{},
+		map[string]int{},
+		map[string]int{},
+		map[string]int{},
+		map[string]int{},
+		map[string]int{},
+	}
+}
+
+func (b *BreakdownReport) add(click *ClickLog) {
+	incr_map(&b.Gender, click.Gender)
+	incr_map(&b.Agents, click.Agent)
+	incr_map(&b.Generations, generationOf(click.Age))
+
+	ua := click.Agent
+	if ua == "unknown" {
+		// parseClickLine's stand-in for an empty User-Agent.
+		ua = ""
+	}
+	agent := parseUserAgent(ua)
+	incr_map(&b.Devices, agent.Device)
+	incr_map(&b.OS, agent.OS)
+	incr_map(&b.Browsers, agent.Browser)
+}
+
+type breakdownDimension struct {
+	name   string
+	counts map[string]int
+}
+
+// dimensions lists the counts of the breakdown by their JSON names.
+func (b *BreakdownReport) dimensions() []breakdownDimension {
+	return []breakdownDimension{
+		{"gender", b.Gender},
+		{"agents", b.Agents},
+		{"generations", b.Generations},
+		{"devices", b.Devices},
+		{"os", b.OS},
+		{"browsers", b.Browsers},
+	}
+}
+
+func (b *BreakdownReport) copy() *BreakdownReport {
+	c := newBreakdownReport()
+	to := c.dimensions()
+	for i, d := range b.dimensions() {
+		for k, v := range d.counts {
+			to[i].counts[k] = v
+		}
+	}
+	return c
+}
+
+func newClickAggregate() *ClickAggregate {
+	return &ClickAggregate{
+		Breakdown:           newBreakdownReport(),
+		Minutes:             map[int64]int{},
+		Invalid:             map[string]int{},
+		ConversionBreakdown: newBreakdownReport(),
+	}
+}
+
+func (a *ClickAggregate) add(click *ClickLog) {
+	if click.Kind == ClickKindConversion {
+		// Conversions of invalid clicks are logged but never counted.
+		if click.Invalid == "" {
+			if a.ConversionBreakdown == nil {
+				a.ConversionBreakdown = newBreakdownReport()
+			}
+			a.Conversions++
+			a.ConversionBreakdown.add(click)
+		}
+		return
+	}
+	if click.Invalid != "" {
+		if a.Invalid == nil {
+			a.Invalid = map[string]int{}
+		}
+		a.Invalid[click.Invalid]++
+		return
+	}
+	a.Clicks++
+	a.Breakdown.add(click)
+	if !click.At.IsZero() {
+		a.addMinute(minuteOf(click.At))
+	}
+}
+
+// addMinute counts a click in its minute. Minutes are kept as long as
+// impressions per minute are: older ones are not counted, and go in bulk
+// as the map doubles.
+func (a *ClickAggregate) addMinute(minute int64) {
+	oldest := minuteOf(time.Now().Add(-seriesRetention))
+	if minute < oldest {
+		return
+	}
+	if a.Minutes == nil {
+		a.Minutes = map[int64]int{}
+	}
+	a.Minutes[minute]++
+	if len(a.Minutes) >= 1024 && len(a.Minutes)&(len(a.Minutes)-1) == 0 {
+		for m := range a.Minutes {
+			if m < oldest {
+				delete(a.Minutes, m)
+			}
+		}
+	}
+}
+
+func (a *ClickAggregate) copy() *ClickAggregate {
+	c := newClickAggregate()
+	c.Clicks = a.Clicks
+	c.Breakdown = a.Breakdown.copy()
+	for k, v := range a.Minutes {
+		c.Minutes[k] = v
+	}
+	for k, v := range a.Invalid {
+		c.Invalid[k] = v
+	}
+	c.Conversions = a.Conversions
+	if a.ConversionBreakdown != nil {
+		c.ConversionBreakdown = a.ConversionBreakdown.copy()
+	}
+	return c
+}
+
+// InvalidClicks sums up the invalid clicks by reason.
+func (a *ClickAggregate) InvalidClicks() *InvalidClickReport {
+	report := &InvalidClickReport{Reasons: map[string]int{}}
+	for reason, n := range a.Invalid {
+		report.Total += n
+		report.Reasons[reason] = n
+	}
+	return report
+}
+
+// parseClickLine reads "ad_id user agent [unixtime [invalid [kind
+// [click_id]]]]" tab separated lines.
+func parseClickLine(line string) *ClickLog {
+	sp := strings.Split(line, "\t")
+	if len(sp) < 3 {
+		return nil
+	}
+	agent := sp[2]
+	if agent == "" {
+		agent = "unknown"
+	}
+	gender, age := decodeUserKey(sp[1])
+	var at time.Time
+	if len(sp) > 3 {
+		if sec, err := strconv.ParseInt(sp[3], 10, 64); err == nil {
+			at = time.Unix(sec, 0)
+		}
+	}
+	for len(sp) < 7 {
+		sp = append(sp, "")
+	}
+	return &ClickLog{
+		AdId:    sp[0],
+		User:    sp[1],
+		Agent:   agent,
+		Gender:  gender,
+		Age:     age,
+		At:      at,
+		Invalid: sp[4],
+		Kind:    sp[5],
+		ClickId: sp[6],
+	}
+}
+
+var logFieldReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// logField makes a value safe to log in a column of its own. Values such as
+// the User-Agent come from the client, and a tab in one would shift what
+// follows it into the invalid, kind and click_id columns.
+func logField(s string) string {
+	return logFieldReplacer.Replace(s)
+}
+
+// clickIndex is the aggregate state of one advertiser's log up to Offset.
+// It is checkpointed next to the log so a restart only replays the tail.
+// A checkpoint of another Version is rebuilt from the log instead.
+type clickIndex struct {
+	Version int                        `json:"version"`
+	Offset  int64                      `json:"offset"`
+	Ads     map[string]*ClickAggregate `json:"ads"`
+
+	saved int64
+}
+
+// fileClickStore appends one TSV line per click to a per-advertiser log.
+// Writers serialize on flock, so several processes may share the directory;
+// each process catches its index up with whatever was appended since.
+//
+// A click this process writes right after what its index covers is added
+// to the index as it is, without reading the log back. Checkpoints are
+// written in the background.
+type fileClickStore struct {
+	sync.Mutex
+
+	dir     string
+	indexes map[string]*clickIndex
+
+	// checkpointLock serializes checkpoint writes. generation and written,
+	// the offset of each advertiser's last checkpoint, are guarded by it.
+	checkpointLock sync.Mutex
+	generation     int
+	written        map[string]int64
+}
+
+const clickCheckpointBytes = 64 * 1024
+
+// clickIndexVersion changes whenever ClickAggregate gains counts that old
+// checkpoints lack.
+const clickIndexVersion = 1
+
+func newFileClickStore(dir string) *fileClickStore {
+	os.MkdirAll(dir, 0755)
+	return &fileClickStore{
+		dir:     dir,
+		indexes: map[string]*clickIndex{},
+		written: map[string]int64{},
+	}
+}
+
+func (s *fileClickStore) logPath(advrId string) string {
+	splitted := strings.Split(advrId, "/")
+	return filepath.Join(s.dir, splitted[len(splitted)-1])
+}
+
+func (s *fileClickStore) Record(advrId string, click *ClickLog) (int, error) {
+	os.MkdirAll(s.dir, 0755)
+	f, err := os.OpenFile(s.logPath(advrId), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	// Under the lock the end of the file is where the line goes.
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	line := fmt.Sprintf("%s\t%s\t%s\t%d", logField(click.AdId), logField(click.User), logField(click.Agent), click.At.Unix())
+	if click.Invalid != "" || click.Kind != "" || click.ClickId != "" {
+		line += "\t" + click.Invalid + "\t" + click.Kind + "\t" + click.ClickId
+	}
+	_, err = f.WriteString(line + "\n")
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// Lines appended in between, by this process or another, are read by
+	// a sync, this one with them.
+	logged := parseClickLine(line)
+	idx := s.loadIndex(advrId)
+	if idx.Offset == fi.Size() {
+		idx.add(logged)
+		idx.Offset += int64(len(line) + 1)
+		s.checkpoint(advrId, idx)
+	} else if idx, err = s.sync(advrId); err != nil {
+		return 0, err
+	}
+	agg, exists := idx.Ads[logged.AdId]
+	if !exists || click.Invalid != "" {
+		return 0, nil
+	}
+	if click.Kind == ClickKindConversion {
+		return agg.Conversions, nil
+	}
+	return agg.Clicks, nil
+}
+
+func (s *fileClickStore) Aggregates(advrId string, with int) (map[string]*ClickAggregate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, err := s.sync(advrId)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*ClickAggregate{}
+	for adId, agg := range idx.Ads {
+		result[adId] = agg.copy()
+	}
+	return result, nil
+}
+
+func (s *fileClickStore) Clear() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dropIndexes()
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, 0755)
+}
+
+func (s *fileClickStore) Reload() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dropIndexes()
+}
+
+// dropIndexes forgets the indexes, to be rebuilt from the logs. Checkpoints
+// still being written are of logs about to go. Callers hold s.
+func (s *fileClickStore) dropIndexes() {
+	s.checkpointLock.Lock()
+	s.generation++
+	s.written = map[string]int64{}
+	s.checkpointLock.Unlock()
+
+	s.indexes = map[string]*clickIndex{}
+}
+
+// logs lists the advertiser logs in the directory, leaving out checkpoints.
+func (s *fileClickStore) logs() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && !strings.HasSuffix(fi.Name(), ".idx") && !strings.HasSuffix(fi.Name(), ".tmp") {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *fileClickStore) Snapshot(dir string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names, err := s.logs()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		// Writers hold LOCK_EX while appending, so this sees whole lines.
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+		if err == nil {
+			err = copyFile(filepath.Join(dir, name), f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileClickStore) Restore(dir string) error {
+	if err := s.Clear(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		err = copyFile(filepath.Join(s.dir, fi.Name()), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileClickStore) loadIndex(advrId string) *clickIndex {
+	if idx, exists := s.indexes[advrId]; exists {
+		return idx
+	}
+
+	idx := &clickIndex{Version: clickIndexVersion, Ads: map[string]*ClickAggregate{}}
+	if data, err := ioutil.ReadFile(s.logPath(advrId) + ".idx"); err == nil {
+		saved := &clickIndex{}
+		if json.Unmarshal(data, saved) == nil && saved.Version == clickIndexVersion && saved.Ads != nil {
+			saved.saved = saved.Offset
+			idx = saved
+		}
+	}
+	s.indexes[advrId] = idx
+	return idx
+}
+
+func (idx *clickIndex) add(click *ClickLog) {
+	if click == nil {
+		return
+	}
+	agg, exists := idx.Ads[click.AdId]
+	if !exists {
+		agg = newClickAggregate()
+		idx.Ads[click.AdId] = agg
+	}
+	agg.add(click)
+}
+
+// checkpoint saves the index once clickCheckpointBytes were added since
+// the last time. Only the encoding happens here; the file is written in
+// the background. Callers hold s.
+func (s *fileClickStore) checkpoint(advrId string, idx *clickIndex) {
+	if idx.Offset-idx.saved < clickCheckpointBytes {
+		return
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		panic(err)
+	}
+	idx.saved = idx.Offset
+
+	s.checkpointLock.Lock()
+	generation := s.generation
+	s.checkpointLock.Unlock()
+	go func(offset int64) {
+		if err := s.saveIndex(advrId, data, offset, generation); err != nil {
+			log.Print("click checkpoint: ", err)
+		}
+	}(idx.Offset)
+}
+
+// saveIndex writes a checkpoint unless a later one was written already, or
+// the logs were cleared since it was taken.
+func (s *fileClickStore) saveIndex(advrId string, data []byte, offset int64, generation int) error {
+	s.checkpointLock.Lock()
+	defer s.checkpointLock.Unlock()
+
+	if generation != s.generation || offset <= s.written[advrId] {
+		return nil
+	}
+	path := s.logPath(advrId) + ".idx"
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.written[advrId] = offset
+	return nil
+}
+
+// sync applies every complete line appended after idx.Offset. Callers hold s.
+func (s *fileClickStore) sync(advrId string) (*clickIndex, error) {
+	idx := s.loadIndex(advrId)
+
+	f, err := os.Open(s.logPath(advrId))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < idx.Offset {
+		// The log was replaced underneath a stale checkpoint.
+		idx = &clickIndex{Version: clickIndexVersion, Ads: map[string]*ClickAggregate{}}
+		s.indexes[advrId] = idx
+	}
+	if fi.Size() == idx.Offset {
+		return idx, nil
+	}
+
+	if _, err = f.Seek(idx.Offset, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// An unterminated line is a write still in flight; leave it.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		idx.Offset += int64(len(line))
+		idx.add(parseClickLine(strings.TrimRight(line, "\n")))
+	}
+
+	s.checkpoint(advrId, idx)
+	return idx, nil
+}
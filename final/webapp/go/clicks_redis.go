@@ -0,0 +1,226 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// redisClickStore keeps the aggregates themselves in Redis, so that every
+// app node sharing the Redis reports the same numbers. A click is a handful
+// of HINCRBYs in one MULTI; the log lines the file store keeps are not kept.
+//
+// Each advertiser has three hashes, so that a report reads only what it
+// shows. Fields are the ad ID and a count name separated by tabs:
+//
+//	isu4:clicks:ADVERTISER             ID clicks
+//	                                   ID conversions
+//	                                   ID invalid REASON
+//	isu4:click-breakdown:ADVERTISER    ID breakdown DIMENSION KEY
+//	                                   ID conversion_breakdown DIMENSION KEY
+//	isu4:click-minutes:ADVERTISER:DAY  ID minutes UNIXTIME
+//
+// The minutes of a day, DAY being the unix time it starts at, expire
+// seriesRetention after they were last counted into, as impressions do.
+type redisClickStore struct {
+	rd *redis.Client
+}
+
+func newRedisClickStore(opts *redis.Options) *redisClickStore {
+	return &redisClickStore{redis.NewClient(opts)}
+}
+
+var clickAggregatesPrefixes = []string{"isu4:clicks:", "isu4:click-breakdown:", "isu4:click-minutes:"}
+
+// clickAggregatesKey is the hash of the advertiser the field belongs in.
+func clickAggregatesKey(advrId string, field string) string {
+	switch strings.SplitN(field, "\t", 3)[1] {
+	case "breakdown", "conversion_breakdown":
+		return clickAggregatesPrefixes[1] + advrId
+	case "minutes":
+		minute, _ := strconv.ParseInt(strings.SplitN(field, "\t", 4)[2], 10, 64)
+		return clickMinutesKey(advrId, minute-minute%86400)
+	}
+	return clickAggregatesPrefixes[0] + advrId
+}
+
+func clickMinutesKey(advrId string, day int64) string {
+	return clickAggregatesPrefixes[2] + advrId + ":" + strconv.FormatInt(day, 10)
+}
+
+func (a *ClickAggregate) fields(adId string) map[string]int {
+	fields := map[string]int{}
+	add := func(n int, name ...string) {
+		if n != 0 {
+			fields[adId+"\t"+strings.Join(name, "\t")] += n
+		}
+	}
+
+	add(a.Clicks, "clicks")
+	add(a.Conversions, "conversions")
+	for reason, n := range a.Invalid {
+		add(n, "invalid", reason)
+	}
+	for minute, n := range a.Minutes {
+		add(n, "minutes", strconv.FormatInt(minute, 10))
+	}
+	for _, breakdown := range []struct {
+		name string
+		b    *BreakdownReport
+	}{{"breakdown", a.Breakdown}, {"conversion_breakdown", a.ConversionBreakdown}} {
+		if breakdown.b == nil {
+			continue
+		}
+		for _, d := range breakdown.b.dimensions() {
+			for k, n := range d.counts {
+				add(n, breakdown.name, d.name, k)
+			}
+		}
+	}
+	return fields
+}
+
+// addField adds n to the count a field names, the field's ad ID left out.
+// Fields it does not know are ignored.
+func (a *ClickAggregate) addField(name string, n int) {
+	// Breakdown keys can hold tabs of their own, so only three parts.
+	parts := strings.SplitN(name, "\t", 3)
+	switch {
+	case parts[0] == "clicks":
+		a.Clicks += n
+	case parts[0] == "conversions":
+		a.Conversions += n
+	case parts[0] == "invalid" && len(parts) == 2:
+		a.Invalid[parts[1]] += n
+	case parts[0] == "minutes" && len(parts) == 2:
+		if minute, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			a.Minutes[minute] += n
+		}
+	case parts[0] == "breakdown" && len(parts) == 3:
+		a.Breakdown.addCount(parts[1], parts[2], n)
+	case parts[0] == "conversion_breakdown" && len(parts) == 3:
+		a.ConversionBreakdown.addCount(parts[1], parts[2], n)
+	}
+}
+
+func (b *BreakdownReport) addCount(dimension string, key string, n int) {
+	for _, d := range b.dimensions() {
+		if d.name == dimension {
+			d.counts[key] += n
+		}
+	}
+}
+
+func (s *redisClickStore) Record(advrId string, click *ClickLog) (int, error) {
+	gender, age := decodeUserKey(click.User)
+	logged := *click
+	logged.Gender, logged.Age = gender, age
+	if logged.Agent == "" {
+		logged.Agent = "unknown"
+	}
+	delta := newClickAggregate()
+	delta.add(&logged)
+
+	count := click.AdId + "\tclicks"
+	if click.Kind == ClickKindConversion {
+		count = click.AdId + "\tconversions"
+	}
+	var total *redis.IntCmd
+	multi := s.rd.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		for field, n := range delta.fields(click.AdId) {
+			key := clickAggregatesKey(advrId, field)
+			cmd := multi.HIncrBy(key, field, int64(n))
+			if field == count {
+				total = cmd
+			}
+			if strings.HasPrefix(key, clickAggregatesPrefixes[2]) {
+				multi.Expire(key, seriesRetention)
+			}
+		}
+		return nil
+	})
+	if err != nil || total == nil {
+		return 0, err
+	}
+	return int(total.Val()), nil
+}
+
+func (s *redisClickStore) Aggregates(advrId string, with int) (map[string]*ClickAggregate, error) {
+	keys := []string{clickAggregatesPrefixes[0] + advrId}
+	if with&AggregateBreakdown != 0 {
+		keys = append(keys, clickAggregatesPrefixes[1]+advrId)
+	}
+	if with&AggregateMinutes != 0 {
+		oldest := minuteOf(time.Now().Add(-seriesRetention))
+		for day := oldest - oldest%86400; day <= time.Now().Unix(); day += 86400 {
+			keys = append(keys, clickMinutesKey(advrId, day))
+		}
+	}
+	pipe := s.rd.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAllMap(key)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	result := map[string]*ClickAggregate{}
+	for _, cmd := range cmds {
+		for field, value := range cmd.Val() {
+			parts := strings.SplitN(field, "\t", 2)
+			n, err := strconv.Atoi(value)
+			if len(parts) != 2 || err != nil {
+				continue
+			}
+			agg, exists := result[parts[0]]
+			if !exists {
+				agg = newClickAggregate()
+				result[parts[0]] = agg
+			}
+			agg.addField(parts[1], n)
+		}
+	}
+	return result, nil
+}
+
+func (s *redisClickStore) Clear() error {
+	for _, prefix := range clickAggregatesPrefixes {
+		cursor := int64(0)
+		for {
+			next, keys, err := s.rd.Scan(cursor, prefix+"*", 1000).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err = s.rd.Del(keys...).Err(); err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return nil
+}
+
+// Reload has nothing to drop: every read goes to Redis.
+func (s *redisClickStore) Reload() {}
+
+// Snapshot and Restore leave the aggregates alone: they are isu4:* keys,
+// which the Redis AdStore snapshot already carries.
+func (s *redisClickStore) Snapshot(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (s *redisClickStore) Restore(dir string) error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClickAggregatesKey(t *testing.T) {
+	cases := []struct {
+		field string
+		want  string
+	}{
+		{"1\tclicks", "isu4:clicks:a"},
+		{"1\tinvalid\tbot", "isu4:clicks:a"},
+		{"1\tbreakdown\tagents\tMozilla\t5.0", "isu4:click-breakdown:a"},
+		{"1\tconversion_breakdown\tgender\tmale", "isu4:click-breakdown:a"},
+		{"1\tminutes\t1413625260", "isu4:click-minutes:a:1413590400"},
+	}
+	for _, c := range cases {
+		if got := clickAggregatesKey("a", c.field); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.field, got, c.want)
+		}
+	}
+}
+
+func TestClickAggregateFields(t *testing.T) {
+	agg := newClickAggregate()
+	agg.add(&ClickLog{AdId: "1", Agent: "Mozilla/5.0\tX", Gender: "male", Age: 30, At: time.Now()})
+	agg.add(&ClickLog{AdId: "1", Invalid: "bot"})
+	agg.add(&ClickLog{AdId: "1", Kind: ClickKindConversion, Gender: "female", Age: 20})
+
+	got := newClickAggregate()
+	for field, n := range agg.fields("1") {
+		got.addField(strings.TrimPrefix(field, "1\t"), n)
+	}
+	if !reflect.DeepEqual(got, agg) {
+		t.Errorf("got %+v, want %+v", got, agg)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseClickLine(t *testing.T) {
+	cases := []struct {
+		line string
+		want *ClickLog
+	}{
+		{"1\t0/25\tchrome", &ClickLog{AdId: "1", User: "0/25", Agent: "chrome", Gender: "female", Age: 25}},
+		{"1\t\t", &ClickLog{AdId: "1", Agent: "unknown", Gender: "unknown", Age: -1}},
+		{"2\t1/40\tfirefox\t1413625200\tbot\tconversion\tc1", &ClickLog{
+			AdId: "2", User: "1/40", Agent: "firefox", Gender: "male", Age: 40,
+			At: time.Unix(1413625200, 0), Invalid: "bot", Kind: "conversion", ClickId: "c1",
+		}},
+		{"2\t1/40\tfirefox\tsoon", &ClickLog{AdId: "2", User: "1/40", Agent: "firefox", Gender: "male", Age: 40}},
+		{"1\t0/25", nil},
+		{"", nil},
+	}
+	for _, c := range cases {
+		got := parseClickLine(c.line)
+		if got == nil || c.want == nil {
+			if got != c.want {
+				t.Errorf("%q: got %+v, want %+v", c.line, got, c.want)
+			}
+			continue
+		}
+		if !got.At.Equal(c.want.At) {
+			t.Errorf("%q: got time %v, want %v", c.line, got.At, c.want.At)
+		}
+		got.At, c.want.At = time.Time{}, time.Time{}
+		if *got != *c.want {
+			t.Errorf("%q: got %+v, want %+v", c.line, *got, *c.want)
+		}
+	}
+}
+
+func TestFileClickStoreEscapesColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isu4-clicks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Unescaped, this User-Agent would end the log line's agent column and
+	// leave the invalid column empty, billing the click.
+	agent := "evilbot\t1413625200\t\t\t\t\nx"
+	cases := []*ClickLog{
+		{AdId: "1", User: "1/25", Agent: agent, At: time.Now(), Invalid: InvalidClickBot},
+		{AdId: "1", User: "1/25\t", Agent: agent, At: time.Now()},
+	}
+	s := newFileClickStore(dir)
+	for _, click := range cases {
+		if _, err := s.Record("a", click); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fresh store reads everything back from the log.
+	for _, s := range []*fileClickStore{s, newFileClickStore(dir)} {
+		aggs, err := s.Aggregates("a", AggregateBreakdown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg := aggs["1"]
+		if agg == nil || agg.Clicks != 1 || agg.Invalid[InvalidClickBot] != 1 || len(aggs) != 1 {
+			t.Fatalf("got %+v", aggs)
+		}
+		if n := agg.Breakdown.Agents["evilbot 1413625200     x"]; n != 1 {
+			t.Errorf("agents: got %v", agg.Breakdown.Agents)
+		}
+	}
+}
+
+func TestClickAggregateTrimsMinutes(t *testing.T) {
+	now := time.Now()
+	agg := newClickAggregate()
+	agg.add(&ClickLog{AdId: "1", At: now.Add(-seriesRetention - time.Hour)})
+	if agg.Clicks != 1 || len(agg.Minutes) != 0 {
+		t.Errorf("a click past retention: got %d clicks, minutes %v", agg.Clicks, agg.Minutes)
+	}
+
+	for i := int64(0); i < 1023; i++ {
+		agg.Minutes[minuteOf(now.Add(-seriesRetention))-60*(i+1)] = 1
+	}
+	agg.add(&ClickLog{AdId: "1", At: now})
+	if len(agg.Minutes) != 1 || agg.Minutes[minuteOf(now)] != 1 {
+		t.Errorf("got %d minutes", len(agg.Minutes))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Any number of app nodes can serve behind one Redis, given
+//
+//	ISU4_STORE=redis, which makes              so that they share all counts
+//	ISU4_CLICK_STORE default to redis too
+//	the same ISU4_SERVE_SECRET, or none         as a counter URL one node hands
+//	                                            out may be hit on another
+//	ISU4_ASSET_DIR and ISU4_UPLOAD_DIR          likewise for assets and uploads
+//	on storage they all mount
+//	ISU4_REPORT_PUBSUB=redis                    so that streams see every node
+//
+// What a node keeps for itself, such as the rotation, is reset everywhere
+// by POST /initialize on any one node: it alone flushes the store and clears
+// the shared storage, then resets itself and asks the others to on the
+// isu4:initialize channel. It answers once every node that was listening
+// has acknowledged.
+
+// nodeBus is how nodes sharing a Redis reach one another. Nil with any
+// other store.
+type nodeBus struct {
+	rd *redis.Client
+	id string
+}
+
+var nodes *nodeBus
+
+const initializeChannel = "isu4:initialize"
+
+const nodeResetTimeout = 10 * time.Second
+
+func newNodeBus(opts *redis.Options) *nodeBus {
+	n := &nodeBus{redis.NewClient(opts), randomId()}
+	go n.listen()
+	return n
+}
+
+func randomId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func initializeAckKey(request string) string {
+	return "isu4:initialize:" + request
+}
+
+// clearShared empties what every node shares besides the store. Only the
+// node asked to initialize does it.
+func clearShared() {
+	assets.Clear()
+	uploads.Clear()
+	clicks.Clear()
+}
+
+// resetNode drops what this node keeps for itself, including what it
+// cached of the shared storage.
+func resetNode() {
+	rotation.Reset()
+	clicks.Reload()
+}
+
+func (n *nodeBus) listen() {
+	for {
+		pubsub, err := n.rd.Subscribe(initializeChannel)
+		if err != nil {
+			log.Print("node bus: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.Print("node bus: ", err)
+				break
+			}
+			n.acknowledge(msg.Payload)
+		}
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// acknowledge handles an initialize request, "NODE REQUEST". The node that
+// sent it reset itself already.
+func (n *nodeBus) acknowledge(payload string) {
+	parts := strings.SplitN(payload, " ", 2)
+	if len(parts) != 2 {
+		return
+	}
+	if parts[0] != n.id {
+		resetNode()
+	}
+	defer observeStore("redis-nodes", "acknowledge", time.Now())
+	key := initializeAckKey(parts[1])
+	if err := n.rd.Incr(key).Err(); err != nil {
+		log.Print("node bus: ", err)
+		return
+	}
+	n.rd.Expire(key, nodeResetTimeout)
+}
+
+// resetOthers has every other listening node reset itself and waits until
+// they all have.
+func (n *nodeBus) resetOthers() error {
+	request := randomId()
+	start := time.Now()
+	receivers, err := n.rd.Publish(initializeChannel, n.id+" "+request).Result()
+	observeStore("redis-nodes", "Publish", start)
+	if err != nil {
+		return err
+	}
+
+	key := initializeAckKey(request)
+	defer n.rd.Del(key)
+	deadline := time.Now().Add(nodeResetTimeout)
+	for {
+		start = time.Now()
+		acks, err := n.rd.Get(key).Int64()
+		observeStore("redis-nodes", "Get", start)
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if acks >= receivers {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d of %d nodes reset", acks, receivers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
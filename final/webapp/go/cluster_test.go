@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetNodeLeavesSharedStorage(t *testing.T) {
+	defer useTestStores(t)()
+	hash, _, err := assets.Put(strings.NewReader("creative"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clicks.Record("a", &ClickLog{AdId: "1", At: time.Now()})
+
+	resetNode()
+	if f, err := assets.Open(hash); err != nil {
+		t.Error("resetNode removed the asset: ", err)
+	} else {
+		f.Close()
+	}
+	if aggs, _ := clicks.Aggregates("a", 0); aggs["1"] == nil || aggs["1"].Clicks != 1 {
+		t.Errorf("resetNode lost the click: got %v", aggs)
+	}
+
+	if status, _ := routePostInitialize(); status != 200 {
+		t.Fatalf("initialize: got %d", status)
+	}
+	if _, err := assets.Open(hash); err == nil {
+		t.Error("initialize left the asset")
+	}
+	if aggs, _ := clicks.Aggregates("a", 0); len(aggs) != 0 {
+		t.Errorf("initialize left the clicks: got %v", aggs)
+	}
+}
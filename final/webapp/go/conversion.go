@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+// Every redirect gets a click ID, passed to the destination as
+// isu4_click_id. The advertiser reports a conversion with it, either from
+// the landing page through the pixel
+//
+//	GET /conversions/pixel?click_id=...
+//
+// or from its server through the postback
+//
+//	POST /conversions   click_id=...
+//
+// A click converts at most once, within ISU4_CONVERSION_WINDOW of the click.
+// The click ID has to be given: a cookie would let any page showing the
+// pixel convert whatever its visitor clicked last.
+
+const ClickKindConversion = "conversion"
+
+var conversionWindow = newConversionWindow()
+
+func newConversionWindow() time.Duration {
+	window, err := time.ParseDuration(getEnv("ISU4_CONVERSION_WINDOW", "168h"))
+	if err != nil {
+		panic(err)
+	}
+	return window
+}
+
+type Conversion struct {
+	ClickId string    `json:"click_id"`
+	Slot    string    `json:"slot"`
+	AdId    string    `json:"ad_id"`
+	At      time.Time `json:"at"`
+}
+
+// transparentGif is the smallest valid 1x1 transparent GIF.
+var transparentGif = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+func newClickId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// withClickId adds the click ID to the destination for the landing page to
+// hand back. Destinations that do not parse are left alone.
+func withClickId(destination string, clickId string) string {
+	u, err := url.Parse(destination)
+	if destination == "" || err != nil {
+		return destination
+	}
+	query := u.Query()
+	query.Set("isu4_click_id", clickId)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// trackClick saves the click for conversion tracking.
+func trackClick(click *ClickLog) {
+	if err := store.SaveClick(click, conversionWindow); err != nil {
+		panic(err)
+	}
+}
+
+// convert logs a conversion of the click. It returns false when the click
+// converted before.
+func convert(click *ClickLog, at time.Time) (*Conversion, bool) {
+	if !store.ClaimServe(ClickKindConversion, click.ClickId, conversionWindow) {
+		return nil, false
+	}
+	total, err := clicks.Record(click.Advertiser, &ClickLog{
+		AdId:    click.AdId,
+		User:    click.User,
+		Agent:   click.Agent,
+		At:      at,
+		Invalid: click.Invalid,
+		Kind:    ClickKindConversion,
+		ClickId: click.ClickId,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if click.Invalid == "" {
+		reportBroker.Publish(click.Advertiser, &ReportDelta{Slot: click.Slot, AdId: click.AdId, Conversions: 1, Total: total, At: at})
+	}
+	return &Conversion{click.ClickId, click.Slot, click.AdId, at}, true
+}
+
+// routeGetConversionPixel always answers the pixel, so that a broken or
+// replayed conversion never shows on the advertiser's page.
+func routeGetConversionPixel(res http.ResponseWriter, req *http.Request) {
+	if clickId := req.URL.Query().Get("click_id"); clickId != "" {
+		if click := store.GetClick(clickId); click != nil {
+			convert(click, time.Now())
+		}
+	}
+
+	res.Header().Set("Content-Type", "image/gif")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(200)
+	res.Write(transparentGif)
+}
+
+func routePostConversion(r render.Render, req *http.Request) {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return
+	}
+
+	req.ParseForm()
+	click := store.GetClick(req.Form.Get("click_id"))
+	if click == nil {
+		r.JSON(404, &ErrorResponse{Error: "unknown_click", Field: "click_id"})
+		return
+	}
+	if click.Advertiser != advrId {
+		r.JSON(403, map[string]string{"error": "forbidden"})
+		return
+	}
+
+	conversion, ok := convert(click, time.Now())
+	if !ok {
+		r.JSON(409, &ErrorResponse{Error: "already_converted", Field: "click_id"})
+		return
+	}
+	r.JSON(201, conversion)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrequencyCap limits how often one viewer sees the same ad: at most Limit
+// impressions within Window. A Limit of 0 turns capping off.
+//
+// Viewers are told apart by their Identity key. Fallback decides what
+// happens to unknown viewers: "none" leaves them uncapped, "ip" caps them
+// by client address instead.
+type FrequencyCap struct {
+	Limit    int
+	Window   time.Duration
+	Fallback string
+}
+
+var frequencyCap = newFrequencyCap()
+
+func newFrequencyCap() *FrequencyCap {
+	limit, err := strconv.Atoi(getEnv("ISU4_FREQUENCY_CAP", "0"))
+	if err != nil {
+		panic(err)
+	}
+	window, err := time.ParseDuration(getEnv("ISU4_FREQUENCY_WINDOW", "1h"))
+	if err != nil {
+		panic(err)
+	}
+	fallback := getEnv("ISU4_FREQUENCY_FALLBACK", "none")
+	if fallback != "none" && fallback != "ip" {
+		panic("unknown frequency cap fallback: " + fallback)
+	}
+
+	return &FrequencyCap{limit, window, fallback}
+}
+
+// trustedProxies are the peers whose X-Forwarded-For is believed, given in
+// ISU4_TRUSTED_PROXIES as comma separated CIDRs or addresses. By default
+// nobody's is: anyone can send the header.
+var trustedProxies = newTrustedProxies(getEnv("ISU4_TRUSTED_PROXIES", ""))
+
+func newTrustedProxies(list string) []*net.IPNet {
+	proxies := []*net.IPNet{}
+	for _, s := range splitList(list) {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the client address. Behind trusted proxies it is the
+// rightmost X-Forwarded-For hop that is not one of them: hops to the left
+// of it were added by whoever sent the request and prove nothing.
+func remoteIP(req *http.Request) string {
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+
+	hops := []string{}
+	for _, header := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && trustedProxy(addr); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+// key returns the key impressions are counted under, or "" when the
+// viewer is not subject to capping.
+func (f *FrequencyCap) key(viewer *Identity) string {
+	if f.Limit <= 0 {
+		return ""
+	}
+	if viewer.Key != "" {
+		return viewer.Key
+	}
+	if f.Fallback == "ip" {
+		return "ip:" + viewer.Address
+	}
+	return ""
+}
+
+// Filter returns the ads of the slot the viewer may be shown once more.
+func (f *FrequencyCap) Filter(viewer *Identity, slot string, ads []*Ad) []*Ad {
+	key := f.key(viewer)
+	if key == "" || len(ads) == 0 {
+		return ads
+	}
+	ids := make([]string, len(ads))
+	for i, ad := range ads {
+		ids[i] = ad.Id
+	}
+	since := time.Now().Add(-f.Window)
+	allowed := []*Ad{}
+	for i, n := range store.CountViewsEach(key, slot, ids, since) {
+		if n < f.Limit {
+			allowed = append(allowed, ads[i])
+		}
+	}
+	return allowed
+}
+
+func (f *FrequencyCap) Record(viewer *Identity, slot string, id string) {
+	key := f.key(viewer)
+	if key == "" {
+		return
+	}
+	store.RecordView(key, slot, id, time.Now(), f.Window)
+}
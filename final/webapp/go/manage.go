@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// ownedAd loads the ad named by the route and makes sure the requesting
+// advertiser owns it. It writes the error response itself and returns nil
+// when the request must not go on.
+func ownedAd(r render.Render, req *http.Request, params martini.Params) *Ad {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return nil
+	}
+
+	ad := store.GetAd(params["slot"], params["id"])
+	if ad == nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return nil
+	}
+	if ad.Advertiser != advrId {
+		r.JSON(403, map[string]string{"error": "forbidden"})
+		return nil
+	}
+	return ad
+}
+
+func routePutAd(r render.Render, req *http.Request, params martini.Params) {
+	ad := ownedAd(r, req, params)
+	if ad == nil {
+		return
+	}
+
+	req.ParseForm()
+	ad.Title = req.Form.Get("title")
+	ad.Destination = req.Form.Get("destination")
+	ad.Weight, ad.ImpressionCap, ad.DailyImpressionCap = 1, 0, 0
+	ad.Targeting = Targeting{}
+	if code := parseDelivery(req.Form, ad); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+	if code := parseTargeting(req.Form, &ad.Targeting); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+	store.UpdateAd(ad)
+
+	r.JSON(200, getAd(req, ad.Slot, ad.Id))
+}
+
+func routePatchAd(r render.Render, req *http.Request, params martini.Params) {
+	ad := ownedAd(r, req, params)
+	if ad == nil {
+		return
+	}
+
+	req.ParseForm()
+	if a := req.Form["title"]; a != nil {
+		ad.Title = a[0]
+	}
+	if a := req.Form["destination"]; a != nil {
+		ad.Destination = a[0]
+	}
+	if code := parseDelivery(req.Form, ad); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+	if code := parseTargeting(req.Form, &ad.Targeting); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+	store.UpdateAd(ad)
+
+	r.JSON(200, getAd(req, ad.Slot, ad.Id))
+}
+
+// routeDeleteAd drops the ad and its rotation entry. The creative stays in
+// the asset store since other ads may share its content.
+func routeDeleteAd(r render.Render, req *http.Request, params martini.Params) {
+	ad := ownedAd(r, req, params)
+	if ad == nil {
+		return
+	}
+
+	store.DeleteAd(ad)
+	rotation.Forget(ad.Slot, ad.Id)
+	r.Status(204)
+}
+
+func routePostAdPause(r render.Render, req *http.Request, params martini.Params) {
+	ad := ownedAd(r, req, params)
+	if ad == nil {
+		return
+	}
+
+	if ad.Status != AdStatusPaused {
+		if _, err := store.SetAdStatus(ad.Slot, ad.Id, AdStatusPaused); err != nil {
+			panic(err)
+		}
+	}
+	r.JSON(200, getAd(req, ad.Slot, ad.Id))
+}
+
+func routePostAdResume(r render.Render, req *http.Request, params martini.Params) {
+	ad := ownedAd(r, req, params)
+	if ad == nil {
+		return
+	}
+
+	if ad.Status == AdStatusPaused {
+		if _, err := store.SetAdStatus(ad.Slot, ad.Id, AdStatusActive); err != nil {
+			panic(err)
+		}
+	}
+	r.JSON(200, getAd(req, ad.Slot, ad.Id))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	defer useTestStores(t)()
+	ad := &Ad{Slot: "s", Id: store.NextAdId(), Advertiser: "a", Status: AdStatusActive, Weight: 1}
+	store.SaveAd(ad)
+	store.PushSlotAd("s", ad.Id)
+
+	req, _ := http.NewRequest("POST", "http://localhost/slots/s/ads/1/pause", nil)
+	req.Header.Set("X-Advertiser-Id", "a")
+	params := martini.Params{"slot": "s", "id": ad.Id}
+
+	routePostAdPause(&testRender{}, req, params)
+	if got := store.GetAd("s", ad.Id); got.Status != AdStatusPaused || len(store.SlotAds("s")) != 0 {
+		t.Errorf("paused: got %s in %v", got.Status, store.SlotAds("s"))
+	}
+
+	// Two resumes that both saw the ad paused.
+	store.SetAdStatus("s", ad.Id, AdStatusActive)
+	store.SetAdStatus("s", ad.Id, AdStatusActive)
+	routePostAdResume(&testRender{}, req, params)
+	if got := store.GetAd("s", ad.Id); got.Status != AdStatusActive || len(store.SlotAds("s")) != 1 {
+		t.Errorf("resumed: got %s in %v", got.Status, store.SlotAds("s"))
+	}
+
+	if ok, _ := store.SetAdStatus("s", "9", AdStatusActive); ok || len(store.SlotAds("s")) != 1 {
+		t.Error("resumed an ad that does not exist")
+	}
+}
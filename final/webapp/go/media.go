@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+)
+
+var (
+	ErrUnknownContainer = errors.New("Unknown container")
+	ErrBrokenContainer  = errors.New("Broken container")
+)
+
+var supportedTypes = []string{"video/mp4", "video/webm"}
+
+// MediaInfo is what probing a creative tells us. Duration is in seconds;
+// fields the container does not carry are left zero.
+type MediaInfo struct {
+	Type     string  `json:"type"`
+	Duration float64 `json:"duration"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Size     int64   `json:"size"`
+}
+
+// probeMedia sniffs the container from its magic bytes and reads its
+// metadata. Only headers are read; media data is skipped with Seek, so
+// memory use does not depend on the size of the file.
+func probeMedia(r io.ReadSeeker, size int64) (*MediaInfo, error) {
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(r, head)
+	head = head[:n]
+	if _, err := r.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	var info *MediaInfo
+	var err error
+	switch {
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		if !isMP4(r, size) {
+			return nil, ErrUnknownContainer
+		}
+		info, err = probeMP4(r, size)
+	case len(head) >= 4 && bytes.Equal(head[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		info, err = probeWebM(r, size)
+	default:
+		return nil, ErrUnknownContainer
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Size = size
+	return info, nil
+}
+
+// mp4Brands are the ftyp brands that make a file MP4. QuickTime, 3GPP,
+// HEIF and AVIF files are boxed the same way, and often list isom among
+// their compatible brands, so their major brands rule them out first.
+var mp4Brands = map[string]bool{
+	"isom": true, "iso2": true, "iso3": true, "iso4": true, "iso5": true, "iso6": true,
+	"mp41": true, "mp42": true, "avc1": true, "dash": true, "M4V ": true,
+}
+
+var otherBrands = []string{"qt  ", "3gp", "3g2", "heic", "heix", "hevc", "mif1", "msf1", "avif", "avis"}
+
+// isMP4 reads the ftyp box at the start of r: its major brand, then a
+// minor version and the compatible brands.
+func isMP4(r io.ReadSeeker, size int64) bool {
+	head := make([]byte, 8)
+	if readAt(r, 0, head) != nil {
+		return false
+	}
+	boxSize := int64(binary.BigEndian.Uint32(head))
+	if boxSize < 16 || boxSize > size || boxSize > 4096 {
+		return false
+	}
+	ftyp := make([]byte, boxSize-8)
+	if readAt(r, 8, ftyp) != nil {
+		return false
+	}
+
+	major := string(ftyp[:4])
+	for _, other := range otherBrands {
+		if strings.HasPrefix(major, other) {
+			return false
+		}
+	}
+	if mp4Brands[major] {
+		return true
+	}
+	for i := 8; i+4 <= len(ftyp); i += 4 {
+		if mp4Brands[string(ftyp[i:i+4])] {
+			return true
+		}
+	}
+	return false
+}
+
+func readAt(r io.ReadSeeker, offset int64, buf []byte) error {
+	if _, err := r.Seek(offset, 0); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, buf)
+	return err
+}
+
+// eachBox calls fn for every ISO BMFF box between start and end with the
+// box type and the bounds of its payload.
+func eachBox(r io.ReadSeeker, start, end int64, fn func(typ string, body, next int64) error) error {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if err := readAt(r, offset, header[:8]); err != nil {
+			return ErrBrokenContainer
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:8])
+		body := offset + 8
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			if err := readAt(r, body, header[8:16]); err != nil {
+				return ErrBrokenContainer
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			body += 8
+		}
+		if size < body-offset || offset+size > end {
+			return ErrBrokenContainer
+		}
+		if err := fn(typ, body, offset+size); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+func probeMP4(r io.ReadSeeker, size int64) (*MediaInfo, error) {
+	info := &MediaInfo{Type: "video/mp4"}
+
+	err := eachBox(r, 0, size, func(typ string, body, next int64) error {
+		if typ != "moov" {
+			return nil
+		}
+		return eachBox(r, body, next, func(typ string, body, next int64) error {
+			switch typ {
+			case "mvhd":
+				buf := make([]byte, 32)
+				if next-body < 32 || readAt(r, body, buf) != nil {
+					return ErrBrokenContainer
+				}
+				var timescale, duration uint64
+				if buf[0] == 1 {
+					timescale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+					duration = binary.BigEndian.Uint64(buf[24:32])
+				} else {
+					timescale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+					duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+				}
+				if timescale > 0 {
+					info.Duration = float64(duration) / float64(timescale)
+				}
+			case "trak":
+				return eachBox(r, body, next, func(typ string, body, next int64) error {
+					if typ != "tkhd" || info.Width > 0 {
+						return nil
+					}
+					version := make([]byte, 1)
+					if readAt(r, body, version) != nil {
+						return ErrBrokenContainer
+					}
+					at := body + 76
+					if version[0] == 1 {
+						at = body + 88
+					}
+					buf := make([]byte, 8)
+					if next < at+8 || readAt(r, at, buf) != nil {
+						return ErrBrokenContainer
+					}
+					// 16.16 fixed point; audio tracks have zero size.
+					info.Width = int(binary.BigEndian.Uint32(buf[0:4]) >> 16)
+					info.Height = int(binary.BigEndian.Uint32(buf[4:8]) >> 16)
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// EBML element IDs used by WebM.
+const (
+	ebmlHeader        = 0x1A45DFA3
+	ebmlDocType       = 0x4282
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlVideo         = 0xE0
+	ebmlPixelWidth    = 0xB0
+	ebmlPixelHeight   = 0xBA
+	ebmlCluster       = 0x1F43B675
+)
+
+// readVint reads an EBML variable length integer at offset. With keepMarker
+// the length marker bit stays in, as element IDs are written that way.
+// unknown is set for a size with every value bit set.
+func readVint(r io.ReadSeeker, offset int64, keepMarker bool) (value uint64, length int64, unknown bool, err error) {
+	first := make([]byte, 1)
+	if err = readAt(r, offset, first); err != nil {
+		return
+	}
+	length = 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		err = ErrBrokenContainer
+		return
+	}
+	rest := make([]byte, length-1)
+	if err = readAt(r, offset+1, rest); err != nil {
+		return
+	}
+
+	value = uint64(first[0])
+	if !keepMarker {
+		value &= uint64(0xFF) >> uint(length)
+	}
+	allOnes := value == uint64(0xFF)>>uint(length)
+	for _, b := range rest {
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	unknown = !keepMarker && allOnes
+	return
+}
+
+// eachElement calls fn for every EBML element between start and end. An
+// element of unknown size runs to end.
+func eachElement(r io.ReadSeeker, start, end int64, fn func(id uint64, body, next int64) (bool, error)) error {
+	for offset := start; offset < end; {
+		id, idLen, _, err := readVint(r, offset, true)
+		if err != nil {
+			return ErrBrokenContainer
+		}
+		size, sizeLen, unknown, err := readVint(r, offset+idLen, false)
+		if err != nil {
+			return ErrBrokenContainer
+		}
+		body := offset + idLen + sizeLen
+		next := end
+		if !unknown {
+			next = body + int64(size)
+			if next > end || next < body {
+				return ErrBrokenContainer
+			}
+		}
+		more, err := fn(id, body, next)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+		offset = next
+	}
+	return nil
+}
+
+// readUint reads an unsigned integer element. Anything over eight bytes is
+// not one, and is left unread whatever size it claims.
+func readUint(r io.ReadSeeker, body, next int64) uint64 {
+	n := next - body
+	if n < 0 || n > 8 {
+		return 0
+	}
+	var buf [8]byte
+	if readAt(r, body, buf[:n]) != nil {
+		return 0
+	}
+	v := uint64(0)
+	for _, b := range buf[:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func readFloat(r io.ReadSeeker, body, next int64) float64 {
+	switch next - body {
+	case 4:
+		return float64(math.Float32frombits(uint32(readUint(r, body, next))))
+	case 8:
+		return math.Float64frombits(readUint(r, body, next))
+	}
+	return 0
+}
+
+func probeWebM(r io.ReadSeeker, size int64) (*MediaInfo, error) {
+	info := &MediaInfo{}
+	scale := uint64(1000000)
+	duration := 0.0
+	seenInfo, seenTracks := false, false
+
+	err := eachElement(r, 0, size, func(id uint64, body, next int64) (bool, error) {
+		switch id {
+		case ebmlHeader:
+			return true, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+				if id == ebmlDocType && next-body < 64 {
+					buf := make([]byte, next-body)
+					if readAt(r, body, buf) != nil {
+						return false, ErrBrokenContainer
+					}
+					// Plain Matroska shares the magic but is not something players take.
+					if string(bytes.TrimRight(buf, "\x00")) == "webm" {
+						info.Type = "video/webm"
+					}
+				}
+				return true, nil
+			})
+		case ebmlSegment:
+			return false, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+				switch id {
+				case ebmlInfo:
+					seenInfo = true
+					return true, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+						switch id {
+						case ebmlTimecodeScale:
+							scale = readUint(r, body, next)
+						case ebmlDuration:
+							duration = readFloat(r, body, next)
+						}
+						return true, nil
+					})
+				case ebmlTracks:
+					seenTracks = true
+					return true, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+						if id != ebmlTrackEntry || info.Width > 0 {
+							return true, nil
+						}
+						return true, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+							if id != ebmlVideo {
+								return true, nil
+							}
+							return true, eachElement(r, body, next, func(id uint64, body, next int64) (bool, error) {
+								switch id {
+								case ebmlPixelWidth:
+									info.Width = int(readUint(r, body, next))
+								case ebmlPixelHeight:
+									info.Height = int(readUint(r, body, next))
+								}
+								return true, nil
+							})
+						})
+					})
+				case ebmlCluster:
+					// Headers come before media data in anything we serve.
+					return false, nil
+				}
+				return !(seenInfo && seenTracks), nil
+			})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Type != "video/webm" {
+		return nil, ErrUnknownContainer
+	}
+	info.Duration = duration * float64(scale) / 1e9
+	return info, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// mp4Box builds an ISO BMFF box of the given type around payload.
+func mp4Box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+// ebmlElement builds an EBML element with an eight byte size.
+func ebmlElement(id []byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	return append(append(append([]byte{}, id...), size...), body...)
+}
+
+func sampleMP4() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 15500)
+	audio := make([]byte, 84)
+	video := make([]byte, 84)
+	binary.BigEndian.PutUint32(video[76:], 1280<<16)
+	binary.BigEndian.PutUint32(video[80:], 720<<16)
+	moov := mp4Box("moov", mp4Box("mvhd", mvhd),
+		mp4Box("trak", mp4Box("tkhd", audio)), mp4Box("trak", mp4Box("tkhd", video)))
+	data := append(mp4Box("ftyp", []byte("isom0000")), moov...)
+	return append(data, mp4Box("mdat", make([]byte, 1000))...)
+}
+
+// ftypAs replaces the ftyp box of sampleMP4 with one of other brands.
+func ftypAs(mp4 []byte, major string, compatible ...string) []byte {
+	ftyp := mp4Box("ftyp", []byte(major), []byte("0000"), []byte(strings.Join(compatible, "")))
+	return append(ftyp, mp4[16:]...)
+}
+
+func sampleWebM() []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(5000))
+	header := ebmlElement([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebmlElement([]byte{0x42, 0x82}, []byte("webm")))
+	info := ebmlElement([]byte{0x15, 0x49, 0xA9, 0x66},
+		ebmlElement([]byte{0x2A, 0xD7, 0xB1}, []byte{0x0F, 0x42, 0x40}),
+		ebmlElement([]byte{0x44, 0x89}, duration))
+	tracks := ebmlElement([]byte{0x16, 0x54, 0xAE, 0x6B},
+		ebmlElement([]byte{0xAE}, ebmlElement([]byte{0xE0},
+			ebmlElement([]byte{0xB0}, []byte{0x02, 0x80}),
+			ebmlElement([]byte{0xBA}, []byte{0x01, 0x68}))))
+	cluster := ebmlElement([]byte{0x1F, 0x43, 0xB6, 0x75}, make([]byte, 100))
+	// A segment of unknown size, as live encoders write it.
+	segment := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	segment = append(segment, bytes.Join([][]byte{info, tracks, cluster}, nil)...)
+	return append(header, segment...)
+}
+
+func TestProbeMedia(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want MediaInfo
+		err  error
+	}{
+		{"mp4", sampleMP4(), MediaInfo{Type: "video/mp4", Duration: 15.5, Width: 1280, Height: 720}, nil},
+		{"webm", sampleWebM(), MediaInfo{Type: "video/webm", Duration: 5, Width: 640, Height: 360}, nil},
+		{"mp4 by compatible brand", ftypAs(sampleMP4(), "XAVC", "mp42"), MediaInfo{Type: "video/mp4", Duration: 15.5, Width: 1280, Height: 720}, nil},
+		{"heic", ftypAs(sampleMP4(), "heic", "mif1", "heic"), MediaInfo{}, ErrUnknownContainer},
+		{"quicktime", ftypAs(sampleMP4(), "qt  ", "qt  "), MediaInfo{}, ErrUnknownContainer},
+		{"3gp", ftypAs(sampleMP4(), "3gp4", "isom", "3gp4"), MediaInfo{}, ErrUnknownContainer},
+		{"avif", ftypAs(sampleMP4(), "avif", "mif1", "miaf"), MediaInfo{}, ErrUnknownContainer},
+		{"unknown brand", ftypAs(sampleMP4(), "abcd", "abcd"), MediaInfo{}, ErrUnknownContainer},
+		{"gif", []byte("GIF89a......."), MediaInfo{}, ErrUnknownContainer},
+		{"empty", []byte{}, MediaInfo{}, ErrUnknownContainer},
+	}
+	for _, c := range cases {
+		size := int64(len(c.data))
+		info, err := probeMedia(bytes.NewReader(c.data), size)
+		if err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		c.want.Size = size
+		if *info != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, *info, c.want)
+		}
+	}
+}
+
+func TestReadUint(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	cases := []struct {
+		body, next int64
+		want       uint64
+	}{
+		{0, 0, 0},
+		{0, 1, 0x01},
+		{1, 3, 0x0203},
+		{0, 8, 0x0102030405060708},
+		{0, 9, 0},
+		{3, 2, 0},
+		{8, 10, 0},
+	}
+	for _, c := range cases {
+		if got := readUint(bytes.NewReader(data), c.body, c.next); got != c.want {
+			t.Errorf("readUint(%d, %d): got %#x, want %#x", c.body, c.next, got, c.want)
+		}
+	}
+}
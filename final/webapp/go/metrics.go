@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in process and served at /metrics in the Prometheus text
+// format. Series are told apart by their rendered label set, as produced by
+// labels, so recording one is a map lookup.
+
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounter("isu4_http_requests_total",
+		"HTTP requests by route template and status.")
+	httpDuration = newHistogram("isu4_http_request_duration_seconds",
+		"HTTP request latency by route template.", latencyBuckets)
+	storeDuration = newHistogram("isu4_store_call_duration_seconds",
+		"AdStore, ClickStore and other Redis call latency by store and operation; _count is the number of calls.", latencyBuckets)
+	clickLogDuration = newHistogram("isu4_click_log_write_seconds",
+		"Click log write latency.", latencyBuckets)
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var metrics = []metric{}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// observeStore records a call into a store, or to Redis outside of one.
+func observeStore(store string, op string, start time.Time) {
+	storeDuration.Since(labels("store", store, "op", op), start)
+}
+
+// labels renders name value pairs as a Prometheus label set without braces.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func seriesName(name string, set string) string {
+	if set == "" {
+		return name
+	}
+	return name + "{" + set + "}"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	sync.Mutex
+
+	name   string
+	help   string
+	values map[string]float64
+}
+
+func newCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help, values: map[string]float64{}}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *Counter) Add(set string, v float64) {
+	c.Lock()
+	c.values[set] += v
+	c.Unlock()
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	sets := map[string]bool{}
+	for set := range c.values {
+		sets[set] = true
+	}
+	for _, set := range sortedKeys(sets) {
+		fmt.Fprintf(w, "%s %g\n", seriesName(c.name, set), c.values[set])
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	sync.Mutex
+
+	name    string
+	help    string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+func newHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *Histogram) Observe(set string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	s, exists := h.series[set]
+	if !exists {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[set] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Since observes the time elapsed since start in seconds.
+func (h *Histogram) Since(set string, start time.Time) {
+	h.Observe(set, time.Since(start).Seconds())
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	sets := map[string]bool{}
+	for set := range h.series {
+		sets[set] = true
+	}
+	for _, set := range sortedKeys(sets) {
+		s := h.series[set]
+		prefix := set
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", h.name, prefix, le, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s %g\n", seriesName(h.name+"_sum", set), s.sum)
+		fmt.Fprintf(w, "%s %d\n", seriesName(h.name+"_count", set), s.count)
+	}
+}
+
+func routeGetMetrics(res http.ResponseWriter) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	res.WriteHeader(200)
+	for _, m := range metrics {
+		m.writeTo(res)
+	}
+}
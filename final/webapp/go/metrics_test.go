@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeteredClickStore(t *testing.T) {
+	defer useTestStores(t)()
+	clicks = newMeteredClickStore(clicks, "file")
+	clicks.Record("a", &ClickLog{AdId: "1", At: time.Now()})
+	clicks.Aggregates("a", 0)
+
+	buf := &bytes.Buffer{}
+	storeDuration.writeTo(buf)
+	for _, op := range []string{"Record", "Aggregates"} {
+		series := `isu4_store_call_duration_seconds_count{store="file-clicks",op="` + op + `"}`
+		if !strings.Contains(buf.String(), series) {
+			t.Errorf("no %s", series)
+		}
+	}
+}
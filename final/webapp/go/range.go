@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxRangeParts bounds how many parts a multipart/byteranges reply has.
+	maxRangeParts = 32
+	// rangeMergeGap is roughly what a multipart part header costs; ranges
+	// closer together than this are cheaper to send as one part.
+	rangeMergeGap = 80
+)
+
+type byteRange struct {
+	start, end int64 // inclusive
+}
+
+// coalesceRange rewrites a Range header for a representation of size bytes
+// the way RFC 7233 section 4.1 allows: overlapping or nearly adjacent ranges
+// are merged regardless of their order. http.ServeContent answers with a
+// full 200 when the requested ranges add up to more than the file, which
+// players that send overlapping ranges would otherwise hit.
+//
+// Headers it cannot parse, and sets with no satisfiable range, are returned
+// untouched so ServeContent produces the usual 416. An empty result means
+// the Range header should be ignored.
+func coalesceRange(header string, size int64) string {
+	if !strings.HasPrefix(header, "bytes=") {
+		return header
+	}
+
+	ranges := []byteRange{}
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return header
+		}
+		head, tail := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var r byteRange
+		if head == "" {
+			n, err := strconv.ParseInt(tail, 10, 64)
+			if err != nil || n < 0 {
+				return header
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, size - 1}
+		} else {
+			start, err := strconv.ParseInt(head, 10, 64)
+			if err != nil || start < 0 {
+				return header
+			}
+			end := size - 1
+			if tail != "" {
+				end, err = strconv.ParseInt(tail, 10, 64)
+				if err != nil || end < start {
+					return header
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, end}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return header
+	}
+
+	sort.Sort(byStart(ranges))
+	merged := []byteRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end+rangeMergeGap {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	if len(merged) > maxRangeParts {
+		return ""
+	}
+
+	specs := make([]string, len(merged))
+	for i, r := range merged {
+		specs[i] = fmt.Sprintf("%d-%d", r.start, r.end)
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
+
+type byStart []byteRange
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStart) Less(i, j int) bool { return b[i].start < b[j].start }
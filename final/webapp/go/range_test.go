@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCoalesceRange(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+	}{
+		{"bytes=0-9", "bytes=0-9"},
+		{"bytes=-10", "bytes=990-999"},
+		{"bytes=-5000", "bytes=0-999"},
+		{"bytes=990-5000", "bytes=990-999"},
+		{"bytes=0-99,50-150", "bytes=0-150"},
+		{"bytes=500-600,0-10", "bytes=0-10,500-600"},
+		{"bytes=0-10,20-30", "bytes=0-30"},
+		{"bytes=2000-", "bytes=2000-"},
+		{"bytes=2000-,0-1", "bytes=0-1"},
+		{"bytes=a-b", "bytes=a-b"},
+		{"items=0-1", "items=0-1"},
+	}
+	for _, c := range cases {
+		if got := coalesceRange(c.header, 1000); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.header, got, c.want)
+		}
+	}
+}
+
+func TestCoalesceRangeTooManyParts(t *testing.T) {
+	header := "bytes=0-0"
+	for start := 100; start < 100*40; start += 100 {
+		header += "," + strconv.Itoa(start) + "-" + strconv.Itoa(start)
+	}
+	if got := coalesceRange(header, 10000); got != "" {
+		t.Errorf("got %q, want it refused", got)
+	}
+}
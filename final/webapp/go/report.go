@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martini-contrib/render"
+)
+
+// eachReport builds the report of every ad of the advertiser and hands them
+// to emit one at a time. With final set each report carries its breakdown.
+// Clicks on ads that no longer exist are reported without an ad.
+func eachReport(advrId string, final bool, emit func(id string, report *Report)) {
+	with := 0
+	if final {
+		with = AggregateBreakdown
+	}
+	aggs, err := clicks.Aggregates(advrId, with)
+	if err != nil {
+		panic(err)
+	}
+
+	seen := map[string]bool{}
+	for _, ad := range store.AdvertiserAds(advrId) {
+		seen[ad.Id] = true
+		agg, exists := aggs[ad.Id]
+		if !exists {
+			agg = newClickAggregate()
+		}
+		report := newReport(agg, final)
+		report.Ad = ad
+		report.Impressions = ad.Impressions
+		emit(ad.Id, report)
+	}
+
+	if final {
+		return
+	}
+	for adId, agg := range aggs {
+		if !seen[adId] {
+			emit(adId, newReport(agg, false))
+		}
+	}
+}
+
+func newReport(agg *ClickAggregate, final bool) *Report {
+	report := &Report{
+		Clicks:      agg.Clicks,
+		Conversions: agg.Conversions,
+	}
+	if agg.Clicks > 0 {
+		report.ConversionRate = float64(agg.Conversions) / float64(agg.Clicks)
+	}
+	if final {
+		report.Breakdown = agg.Breakdown
+		report.InvalidClicks = agg.InvalidClicks()
+		report.ConversionBreakdown = agg.ConversionBreakdown
+		if report.ConversionBreakdown == nil {
+			report.ConversionBreakdown = newBreakdownReport()
+		}
+	}
+	return report
+}
+
+// reportFormat picks json, csv or ndjson from the format parameter, falling
+// back to the Accept header. It returns "" for a format we do not have.
+func reportFormat(req *http.Request) string {
+	if format := req.URL.Query().Get("format"); format != "" {
+		switch format {
+		case "json", "csv", "ndjson":
+			return format
+		}
+		return ""
+	}
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "application/x-ndjson"), strings.Contains(accept, "application/ndjson"):
+		return "ndjson"
+	}
+	return "json"
+}
+
+type reportLine struct {
+	Id string `json:"id"`
+	*Report
+}
+
+var reportColumns = []string{
+	"ad_id", "slot", "title", "advertiser", "destination", "status", "impressions", "clicks",
+	"conversions", "conversion_rate",
+}
+
+var breakdownColumns = []string{"dimension", "key", "count"}
+
+// writeReports answers a report route in the negotiated format. CSV and
+// NDJSON are written and flushed ad by ad instead of being built up front.
+func writeReports(req *http.Request, res http.ResponseWriter, r render.Render, advrId string, final bool) {
+	format := reportFormat(req)
+	if format == "" {
+		r.JSON(400, map[string]string{"error": "invalid_format"})
+		return
+	}
+
+	if format == "json" {
+		reports := map[string]*Report{}
+		eachReport(advrId, final, func(id string, report *Report) {
+			reports[id] = report
+		})
+		r.JSON(200, reports)
+		return
+	}
+
+	flusher, _ := res.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if format == "ndjson" {
+		res.Header().Set("Content-Type", "application/x-ndjson")
+		res.WriteHeader(200)
+		enc := json.NewEncoder(res)
+		eachReport(advrId, final, func(id string, report *Report) {
+			enc.Encode(&reportLine{id, report})
+			flush()
+		})
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	res.WriteHeader(200)
+	w := csv.NewWriter(res)
+	header := reportColumns
+	if final {
+		header = append(append([]string{}, reportColumns...), breakdownColumns...)
+	}
+	w.Write(header)
+	eachReport(advrId, final, func(id string, report *Report) {
+		row := reportRow(id, report)
+		if !final {
+			w.Write(row)
+		} else {
+			rows := append(breakdownRows("", report.Breakdown), breakdownRows("conversion_", report.ConversionBreakdown)...)
+			if len(rows) == 0 {
+				rows = [][]string{{"", "", ""}}
+			}
+			for _, b := range rows {
+				w.Write(append(append([]string{}, row...), b...))
+			}
+		}
+		w.Flush()
+		flush()
+	})
+}
+
+func reportRow(id string, report *Report) []string {
+	row := []string{
+		id, "", "", "", "", "",
+		strconv.Itoa(report.Impressions),
+		strconv.Itoa(report.Clicks),
+		strconv.Itoa(report.Conversions),
+		strconv.FormatFloat(report.ConversionRate, 'f', -1, 64),
+	}
+	if ad := report.Ad; ad != nil {
+		row[1], row[2], row[3], row[4], row[5] = ad.Slot, ad.Title, ad.Advertiser, ad.Destination, ad.Status
+	}
+	return row
+}
+
+// breakdownRows flattens a breakdown into dimension, key, count rows, with
+// prefix put before the dimension names.
+func breakdownRows(prefix string, breakdown *BreakdownReport) [][]string {
+	rows := [][]string{}
+	if breakdown == nil {
+		return rows
+	}
+	for _, d := range breakdown.dimensions() {
+		keys := make([]string, 0, len(d.counts))
+		for k := range d.counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rows = append(rows, []string{prefix + d.name, k, strconv.Itoa(d.counts[k])})
+		}
+	}
+	return rows
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var rotation = newRotation()
+
+func impressionDay(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// HasBudget reports whether the ad may still be served under its total and
+// daily impression caps. A cap of 0 means unlimited. Caps are checked
+// against counted impressions, so concurrent serves can overshoot slightly.
+func (ad *Ad) HasBudget() bool {
+	if ad.ImpressionCap > 0 && ad.Impressions >= ad.ImpressionCap {
+		return false
+	}
+	if ad.DailyImpressionCap > 0 && ad.DailyImpressions >= ad.DailyImpressionCap {
+		return false
+	}
+	return true
+}
+
+// parseDelivery reads weight, impression_cap and daily_impression_cap from
+// the form into ad, leaving fields that are not given alone. It returns an
+// error code for the response when a value is malformed.
+func parseDelivery(form url.Values, ad *Ad) string {
+	fields := []struct {
+		name string
+		min  int
+		dest *int
+	}{
+		{"weight", 1, &ad.Weight},
+		{"impression_cap", 0, &ad.ImpressionCap},
+		{"daily_impression_cap", 0, &ad.DailyImpressionCap},
+	}
+	for _, f := range fields {
+		a := form[f.name]
+		if a == nil || a[0] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(a[0])
+		if err != nil || v < f.min {
+			return "invalid_" + f.name
+		}
+		*f.dest = v
+	}
+	return ""
+}
+
+// Rotation picks ads with smooth weighted round robin: every ad gains its
+// weight each turn and the leader pays back the total. With equal weights
+// this is a plain round robin, and heavier ads are spread out rather than
+// served in bursts. Ads left out of a pick keep their standing, so requests
+// that only qualify for some of the slot's ads do not reset the others.
+//
+// The standings are kept per process. Behind a load balancer each process
+// rotates on its own, so the weights hold across all of them only on
+// average; POST /initialize resets every process's standings.
+type Rotation struct {
+	sync.Mutex
+
+	current map[string]map[string]int
+}
+
+func newRotation() *Rotation {
+	return &Rotation{current: map[string]map[string]int{}}
+}
+
+func (r *Rotation) Pick(slot string, candidates []*Ad) *Ad {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	current, exists := r.current[slot]
+	if !exists {
+		current = map[string]int{}
+		r.current[slot] = current
+	}
+	total := 0
+	var best *Ad
+	for _, ad := range candidates {
+		current[ad.Id] += ad.Weight
+		total += ad.Weight
+		if best == nil || current[ad.Id] > current[best.Id] {
+			best = ad
+		}
+	}
+	current[best.Id] -= total
+
+	return best
+}
+
+func (r *Rotation) Reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.current = map[string]map[string]int{}
+}
+
+// Forget drops the standing of an ad that left the slot.
+func (r *Rotation) Forget(slot string, id string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.current[slot], id)
+}
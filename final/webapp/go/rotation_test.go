@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRotationPick(t *testing.T) {
+	cases := []struct {
+		name  string
+		ads   []*Ad
+		picks int
+		want  string
+	}{
+		{"even", []*Ad{{Id: "a", Weight: 1}, {Id: "b", Weight: 1}}, 4, "abab"},
+		{"weighted", []*Ad{{Id: "a", Weight: 1}, {Id: "b", Weight: 1}, {Id: "c", Weight: 3}}, 5, "cacbc"},
+		{"single", []*Ad{{Id: "a", Weight: 2}}, 3, "aaa"},
+		{"none", []*Ad{}, 2, ""},
+	}
+	for _, c := range cases {
+		r := newRotation()
+		got := ""
+		for i := 0; i < c.picks; i++ {
+			if ad := r.Pick("s", c.ads); ad != nil {
+				got += ad.Id
+			}
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRotationPickKeepsSlotsApart(t *testing.T) {
+	r := newRotation()
+	ads := []*Ad{{Id: "a", Weight: 1}, {Id: "b", Weight: 1}}
+	if ad := r.Pick("s1", ads); ad.Id != "a" {
+		t.Fatalf("s1: got %s, want a", ad.Id)
+	}
+	if ad := r.Pick("s2", ads); ad.Id != "a" {
+		t.Errorf("s2: got %s, want a", ad.Id)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every time an ad is handed out its counter and redirect URLs get a token
+// naming that serve:
+//
+//	?t=SERVE.EXPIRES.hex(HMAC-SHA256(secret, SLOT "\n" ID "\n" SERVE "\n" EXPIRES))
+//
+// so that an impression or a click can only be counted for a serve that
+// really happened, and only once. The secret is ISU4_SERVE_SECRET, or else
+// the one the store keeps, so that every process sharing the store and
+// every process a SIGHUP hands over to accept the same tokens.
+var (
+	serveSecretLock sync.Mutex
+	serveSecretKey  []byte
+)
+
+var serveTTL = newServeTTL()
+
+// serveSecret reads the secret the first time a token is made or checked.
+// Should the store fail it panics, and the next call tries again.
+func serveSecret() []byte {
+	serveSecretLock.Lock()
+	defer serveSecretLock.Unlock()
+
+	if serveSecretKey != nil {
+		return serveSecretKey
+	}
+	if secret := getEnv("ISU4_SERVE_SECRET", ""); secret != "" {
+		serveSecretKey = []byte(secret)
+		return serveSecretKey
+	}
+	secret, err := store.Secret("serve")
+	if err != nil {
+		panic(err)
+	}
+	serveSecretKey = secret
+	return serveSecretKey
+}
+
+func newServeTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("ISU4_SERVE_TTL", "1h"))
+	if err != nil {
+		panic(err)
+	}
+	return ttl
+}
+
+func serveSignature(slot string, id string, serve string, expires string) string {
+	mac := hmac.New(sha256.New, serveSecret())
+	mac.Write([]byte(slot + "\n" + id + "\n" + serve + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newServeToken starts a serve of the ad and returns its token.
+func newServeToken(slot string, id string, now time.Time) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	serve := hex.EncodeToString(buf)
+	expires := strconv.FormatInt(now.Add(serveTTL).Unix(), 10)
+	return serve + "." + expires + "." + serveSignature(slot, id, serve, expires)
+}
+
+// verifyServeToken returns the serve a token was issued for, or "" when it
+// is malformed, forged, for another ad or expired.
+func verifyServeToken(token string, slot string, id string, now time.Time) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	serve, expires, signature := parts[0], parts[1], parts[2]
+	expected := serveSignature(slot, id, serve, expires)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ""
+	}
+	sec, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > sec {
+		return ""
+	}
+	return serve
+}
+
+// claimServe checks the token of the request and makes sure each serve is
+// counted once per kind ("count", "click"). It returns "" when the request
+// may be counted, or why not.
+func claimServe(req *http.Request, kind string, slot string, id string) string {
+	serve := verifyServeToken(req.URL.Query().Get("t"), slot, id, time.Now())
+	if serve == "" {
+		return InvalidClickToken
+	}
+	if !store.ClaimServe(kind, serve, serveTTL) {
+		return InvalidClickReplayed
+	}
+	return ""
+}
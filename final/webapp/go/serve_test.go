@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyServeToken(t *testing.T) {
+	serveSecretLock.Lock()
+	saved := serveSecretKey
+	serveSecretKey = []byte("test secret")
+	serveSecretLock.Unlock()
+	defer func() {
+		serveSecretLock.Lock()
+		serveSecretKey = saved
+		serveSecretLock.Unlock()
+	}()
+
+	now := time.Unix(1413625200, 0)
+	token := newServeToken("s", "1", now)
+	parts := strings.Split(token, ".")
+	serve := parts[0]
+
+	cases := []struct {
+		name  string
+		token string
+		slot  string
+		id    string
+		now   time.Time
+		want  string
+	}{
+		{"valid", token, "s", "1", now, serve},
+		{"valid until it expires", token, "s", "1", now.Add(serveTTL), serve},
+		{"expired", token, "s", "1", now.Add(serveTTL + time.Second), ""},
+		{"other ad", token, "s", "2", now, ""},
+		{"other slot", token, "t", "1", now, ""},
+		{"extended expiry", parts[0] + ".9999999999." + parts[2], "s", "1", now, ""},
+		{"other serve", parts[0] + "0." + parts[1] + "." + parts[2], "s", "1", now, ""},
+		{"bad signature", parts[0] + "." + parts[1] + ".00", "s", "1", now, ""},
+		{"missing part", parts[0] + "." + parts[1], "s", "1", now, ""},
+		{"empty", "", "s", "1", now, ""},
+	}
+	for _, c := range cases {
+		if got := verifyServeToken(c.token, c.slot, c.id, c.now); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The app listens on ISU4_LISTEN, host:port or unix:/path/to/app.sock.
+//
+// SIGTERM and SIGINT stop accepting connections and let requests in flight
+// finish, for at most ISU4_SHUTDOWN_TIMEOUT, before exiting.
+//
+// SIGHUP restarts without dropping a connection: the process starts a new
+// copy of itself, hands it the listening socket in ISU4_LISTEN_FD, and the
+// copy sends the old process SIGTERM once it serves. A supervisor that
+// tracks the pid has to be told about the new one; ISU4_PID_FILE is kept
+// current for that. A socket passed by systemd (LISTEN_FDS) is used too.
+
+func listen(addr string) (net.Listener, error) {
+	if fd := os.Getenv("ISU4_LISTEN_FD"); fd != "" {
+		os.Unsetenv("ISU4_LISTEN_FD")
+		return inheritListener(fd)
+	}
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != "" {
+		// systemd passes sockets from fd 3 on.
+		return inheritListener("3")
+	}
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// The front proxy usually runs as another user.
+		if err = os.Chmod(path, 0666); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func inheritListener(fd string) (net.Listener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// handOff starts a copy of this process serving on l.
+func handOff(l net.Listener) error {
+	filer, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return syscall.EINVAL
+	}
+	f, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "ISU4_LISTEN_FD=3", "ISU4_PARENT_PID="+strconv.Itoa(os.Getpid()))
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("restarted process %d exited: %v", cmd.Process.Pid, err)
+	}()
+	return nil
+}
+
+func writePidFile() {
+	path := getEnv("ISU4_PID_FILE", "")
+	if path == "" {
+		return
+	}
+	err := ioutil.WriteFile(path+".tmp", []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// serve runs handler until the process is told to stop.
+func serve(handler http.Handler) {
+	timeout, err := time.ParseDuration(getEnv("ISU4_SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		panic(err)
+	}
+	l, err := listen(getEnv("ISU4_LISTEN", ":8080"))
+	if err != nil {
+		panic(err)
+	}
+
+	server := &http.Server{Handler: handler}
+	// Shutdown waits for connections to go idle, which streams never do.
+	server.RegisterOnShutdown(closeStreams)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	writePidFile()
+
+	if parent, err := strconv.Atoi(os.Getenv("ISU4_PARENT_PID")); err == nil {
+		os.Unsetenv("ISU4_PARENT_PID")
+		syscall.Kill(parent, syscall.SIGTERM)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-done:
+			panic(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if ul, ok := l.(*net.UnixListener); ok {
+					// The socket file now belongs to the new process.
+					ul.SetUnlinkOnClose(false)
+				}
+				if err := handOff(l); err != nil {
+					log.Print("restart failed: ", err)
+				}
+				continue
+			}
+
+			log.Printf("%v: draining connections", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := server.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Print("shutdown: ", err)
+			}
+			return
+		}
+	}
+}
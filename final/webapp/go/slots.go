@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Slot describes a registered ad slot and the creatives it takes. Slots
+// that were never registered still accept any upload, as they always did.
+// Zero dimensions, sizes and an empty MimeTypes mean no constraint.
+type Slot struct {
+	Id           string   `json:"id"`
+	Owner        string   `json:"owner"`
+	Publisher    string   `json:"publisher"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	MimeTypes    []string `json:"mime_types"`
+	MaxAssetSize int64    `json:"max_asset_size"`
+}
+
+type SlotWithAds struct {
+	*Slot
+	Ads int `json:"ads"`
+}
+
+// ErrorResponse is the body of a rejected request that needs more than an
+// error code to act on.
+type ErrorResponse struct {
+	Error   string      `json:"error"`
+	Message string      `json:"message,omitempty"`
+	Field   string      `json:"field,omitempty"`
+	Allowed interface{} `json:"allowed,omitempty"`
+}
+
+var slotIdPattern = regexp.MustCompile(`^[0-9A-Za-z_\-]+$`)
+
+// checkAsset tells whether a probed creative fits the slot, describing the
+// violation when it does not. Dimensions are only compared when the
+// container carries them.
+func (s *Slot) checkAsset(media *MediaInfo) *ErrorResponse {
+	if len(s.MimeTypes) > 0 && !matchesAny(s.MimeTypes, media.Type) {
+		return &ErrorResponse{
+			Error:   "unsupported_type",
+			Message: "slot " + s.Id + " does not take " + media.Type,
+			Field:   "type",
+			Allowed: s.MimeTypes,
+		}
+	}
+	if s.MaxAssetSize > 0 && media.Size > s.MaxAssetSize {
+		return &ErrorResponse{
+			Error:   "asset_too_large",
+			Message: "asset is " + strconv.FormatInt(media.Size, 10) + " bytes",
+			Field:   "asset",
+			Allowed: s.MaxAssetSize,
+		}
+	}
+	if s.Width > 0 && s.Height > 0 && media.Width > 0 && (media.Width != s.Width || media.Height != s.Height) {
+		return &ErrorResponse{
+			Error:   "invalid_dimensions",
+			Message: "asset is " + strconv.Itoa(media.Width) + "x" + strconv.Itoa(media.Height),
+			Field:   "asset",
+			Allowed: []int{s.Width, s.Height},
+		}
+	}
+	return nil
+}
+
+// slotFromForm reads the constraints of a slot from the form.
+func slotFromForm(req *http.Request, id string, owner string) (*Slot, *ErrorResponse) {
+	req.ParseForm()
+	slot := &Slot{
+		Id:        id,
+		Owner:     owner,
+		Publisher: req.Form.Get("publisher"),
+		MimeTypes: formList(req.Form, "mime_types"),
+	}
+
+	var width, height int64
+	ints := []struct {
+		name string
+		dest *int64
+	}{
+		{"width", &width},
+		{"height", &height},
+		{"max_asset_size", &slot.MaxAssetSize},
+	}
+	for _, f := range ints {
+		v := req.Form.Get(f.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, &ErrorResponse{Error: "invalid_" + f.name, Field: f.name}
+		}
+		*f.dest = n
+	}
+	slot.Width, slot.Height = int(width), int(height)
+	return slot, nil
+}
+
+// usedByOthers tells whether the slot serves ads of advertisers other than
+// advrId, which registering it would hand over to advrId.
+func usedByOthers(slot string, advrId string) bool {
+	for _, id := range store.SlotAds(slot) {
+		if owner := store.AdAdvertiser(slot, id); owner != "" && owner != advrId {
+			return true
+		}
+	}
+	return false
+}
+
+func routePostSlot(r render.Render, req *http.Request) {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return
+	}
+
+	req.ParseForm()
+	id := req.Form.Get("id")
+	if !slotIdPattern.MatchString(id) {
+		r.JSON(400, &ErrorResponse{Error: "invalid_id", Field: "id"})
+		return
+	}
+	slot, invalid := slotFromForm(req, id, advrId)
+	if invalid != nil {
+		r.JSON(400, invalid)
+		return
+	}
+	if usedByOthers(slot.Id, advrId) {
+		r.JSON(409, &ErrorResponse{
+			Error:   "slot_in_use",
+			Message: "slot " + slot.Id + " has ads of other advertisers",
+			Field:   "id",
+		})
+		return
+	}
+
+	created, err := store.CreateSlot(slot)
+	if err != nil {
+		panic(err)
+	}
+	if !created {
+		r.JSON(409, &ErrorResponse{Error: "already_exists", Field: "id"})
+		return
+	}
+
+	r.JSON(201, slot)
+}
+
+// routePutSlot replaces the constraints of a registered slot. Only its
+// owner may, and the owner stays.
+func routePutSlot(r render.Render, req *http.Request, params martini.Params) {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return
+	}
+
+	existing := store.GetSlot(params["slot"])
+	if existing == nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	if existing.Owner != advrId {
+		r.JSON(403, map[string]string{"error": "not_owner"})
+		return
+	}
+	slot, invalid := slotFromForm(req, existing.Id, existing.Owner)
+	if invalid != nil {
+		r.JSON(400, invalid)
+		return
+	}
+
+	updated, err := store.UpdateSlot(slot)
+	if err != nil {
+		panic(err)
+	}
+	if !updated {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	r.JSON(200, slot)
+}
+
+func routeGetSlots(r render.Render) {
+	r.JSON(200, store.Slots())
+}
+
+func routeGetSlot(r render.Render, params martini.Params) {
+	slot := store.GetSlot(params["slot"])
+	if slot == nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	r.JSON(200, &SlotWithAds{slot, len(store.SlotAds(slot.Id))})
+}
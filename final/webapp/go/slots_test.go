@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func slotRequest(method string, advrId string, form url.Values) *http.Request {
+	req, _ := http.NewRequest(method, "http://localhost/slots", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Advertiser-Id", advrId)
+	return req
+}
+
+func TestPostSlot(t *testing.T) {
+	defer useTestStores(t)()
+	store.SaveAd(&Ad{Slot: "taken", Id: "1", Advertiser: "b"})
+	store.PushSlotAd("taken", "1")
+	store.SaveAd(&Ad{Slot: "mine", Id: "2", Advertiser: "a"})
+	store.PushSlotAd("mine", "2")
+
+	cases := []struct {
+		form   url.Values
+		status int
+		code   string
+	}{
+		{url.Values{"id": {"s"}, "width": {"300"}}, 201, ""},
+		{url.Values{"id": {"s"}}, 409, "already_exists"},
+		{url.Values{"id": {"taken"}}, 409, "slot_in_use"},
+		{url.Values{"id": {"mine"}}, 201, ""},
+		{url.Values{"id": {"a b"}}, 400, "invalid_id"},
+		{url.Values{"id": {"t"}, "height": {"-1"}}, 400, "invalid_height"},
+	}
+	for _, c := range cases {
+		r := &testRender{}
+		routePostSlot(r, slotRequest("POST", "a", c.form))
+		if r.status != c.status || r.errorCode() != c.code {
+			t.Errorf("%v: got %d %q, want %d %q", c.form, r.status, r.errorCode(), c.status, c.code)
+		}
+	}
+	if slot := store.GetSlot("s"); slot == nil || slot.Owner != "a" || slot.Width != 300 {
+		t.Errorf("got %+v", slot)
+	}
+}
+
+func TestPutSlot(t *testing.T) {
+	defer useTestStores(t)()
+	store.CreateSlot(&Slot{Id: "s", Owner: "a", Width: 300})
+
+	cases := []struct {
+		slot   string
+		advrId string
+		status int
+	}{
+		{"s", "b", 403},
+		{"none", "a", 404},
+		{"s", "a", 200},
+	}
+	for _, c := range cases {
+		r := &testRender{}
+		req := slotRequest("PUT", c.advrId, url.Values{"width": {"728"}})
+		routePutSlot(r, req, martini.Params{"slot": c.slot})
+		if r.status != c.status {
+			t.Errorf("%s by %s: got %d, want %d", c.slot, c.advrId, r.status, c.status)
+		}
+	}
+	if slot := store.GetSlot("s"); slot == nil || slot.Owner != "a" || slot.Width != 728 {
+		t.Errorf("got %+v", slot)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// A snapshot is a directory under ISU4_SNAPSHOT_DIR holding everything a
+// benchmark run starts from:
+//
+//	meta.json  the Snapshot below
+//	store      the AdStore contents, in a format of that kind of store
+//	clicks/    the click logs, empty for the redis click store whose
+//	           aggregates are in store
+//	assets/    the creatives
+//
+// Restoring one brings ads, counters, slots and clicks back exactly, so a
+// run can be replayed from the same state, and resets every node as
+// /initialize does. Only a snapshot of the same kinds of AdStore and
+// ClickStore restores. Neither is atomic with respect to traffic; take and
+// restore snapshots while the app is idle.
+
+var (
+	ErrSnapshotExists = errors.New("Snapshot already exists")
+	ErrSnapshotStore  = errors.New("Snapshot taken from another kind of store")
+	ErrSnapshotClicks = errors.New("Snapshot taken from another kind of click store")
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[0-9A-Za-z_\-]+$`)
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Store     string    `json:"store"`
+	Clicks    string    `json:"clicks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var snapshotDir = getEnv("ISU4_SNAPSHOT_DIR", getDir("snapshots"))
+
+func copyFile(dst string, src io.Reader) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// linkTree recreates the files of src that keep accepts under dst as hard
+// links, falling back to copies across file systems.
+func linkTree(dst string, src string, keep func(name string) bool) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !keep(fi.Name()) {
+			return nil
+		}
+		if os.Link(path, target) == nil {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return copyFile(target, f)
+	})
+}
+
+func readSnapshot(name string) (*Snapshot, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir, name, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// takeSnapshot writes the snapshot into a scratch directory and renames it
+// into place, so a snapshot that exists is complete.
+func takeSnapshot(name string) (*Snapshot, error) {
+	path := filepath.Join(snapshotDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, ErrSnapshotExists
+	}
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(snapshotDir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Create(filepath.Join(tmp, "store"))
+	if err != nil {
+		return nil, err
+	}
+	err = store.Snapshot(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = clicks.Snapshot(filepath.Join(tmp, "clicks")); err != nil {
+		return nil, err
+	}
+	if err = assets.Snapshot(filepath.Join(tmp, "assets")); err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{name, storeKind, clickStoreKind, time.Now()}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmp, "meta.json"), data, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		if _, serr := os.Stat(path); serr == nil {
+			return nil, ErrSnapshotExists
+		}
+		return nil, err
+	}
+	return snap, nil
+}
+
+// restoreSnapshot replaces the current state with the snapshot. Pending
+// uploads and every node are reset as /initialize does.
+func restoreSnapshot(name string) (*Snapshot, error) {
+	snap, err := readSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Store != storeKind {
+		return nil, ErrSnapshotStore
+	}
+	if snap.Clicks != clickStoreKind {
+		return nil, ErrSnapshotClicks
+	}
+	path := filepath.Join(snapshotDir, name)
+
+	f, err := os.Open(filepath.Join(path, "store"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = store.Restore(f); err != nil {
+		return nil, err
+	}
+	uploads.Clear()
+	if err = assets.Restore(filepath.Join(path, "assets")); err != nil {
+		return nil, err
+	}
+	if err = clicks.Restore(filepath.Join(path, "clicks")); err != nil {
+		return nil, err
+	}
+	resetNode()
+	if nodes != nil {
+		if err = nodes.resetOthers(); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+func routeGetSnapshots(r render.Render) {
+	infos, _ := ioutil.ReadDir(snapshotDir)
+	snaps := []*Snapshot{}
+	for _, fi := range infos {
+		if snap, err := readSnapshot(fi.Name()); err == nil {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Sort(snapshotsByTime(snaps))
+	r.JSON(200, snaps)
+}
+
+type snapshotsByTime []*Snapshot
+
+func (s snapshotsByTime) Len() int           { return len(s) }
+func (s snapshotsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByTime) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+
+func routePostSnapshot(r render.Render, req *http.Request) {
+	req.ParseForm()
+	name := req.Form.Get("name")
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		r.JSON(400, &ErrorResponse{Error: "invalid_name", Field: "name"})
+		return
+	}
+
+	snap, err := takeSnapshot(name)
+	if err == ErrSnapshotExists {
+		r.JSON(409, &ErrorResponse{Error: "already_exists", Field: "name"})
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(201, snap)
+}
+
+func routePostSnapshotRestore(r render.Render, params martini.Params) {
+	snap, err := restoreSnapshot(params["name"])
+	if os.IsNotExist(err) {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	if err == ErrSnapshotStore {
+		r.JSON(409, &ErrorResponse{Error: "store_mismatch", Message: err.Error(), Allowed: storeKind})
+		return
+	}
+	if err == ErrSnapshotClicks {
+		r.JSON(409, &ErrorResponse{Error: "click_store_mismatch", Message: err.Error(), Allowed: clickStoreKind})
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(200, snap)
+}
+
+func routeDeleteSnapshot(r render.Render, params martini.Params) {
+	if _, err := readSnapshot(params["name"]); err != nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(snapshotDir, params["name"])); err != nil {
+		panic(err)
+	}
+	r.Status(204)
+}
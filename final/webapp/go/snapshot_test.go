@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	defer useTestStores(t)()
+	dir, err := ioutil.TempDir("", "isu4-snapshots-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir := snapshotDir
+	defer func() { snapshotDir = savedDir }()
+	snapshotDir = dir
+
+	store.SaveAd(&Ad{Slot: "s", Id: store.NextAdId(), Advertiser: "a", Weight: 1})
+	store.PushSlotAd("s", "1")
+	clicks.Record("a", &ClickLog{AdId: "1", At: time.Now()})
+	if _, err := takeSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Flush()
+	clicks.Clear()
+	if _, err := restoreSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	if !store.ExistsAd("s", "1") {
+		t.Error("the ad was not restored")
+	}
+	if aggs, _ := clicks.Aggregates("a", 0); aggs["1"] == nil || aggs["1"].Clicks != 1 {
+		t.Errorf("clicks: got %v", aggs)
+	}
+
+	clickStoreKind = "redis"
+	if _, err := restoreSnapshot("one"); err != ErrSnapshotClicks {
+		t.Errorf("into another click store: got %v", err)
+	}
+	clickStoreKind = "file"
+
+	meta := filepath.Join(snapshotDir, "one", "meta.json")
+	data, _ := ioutil.ReadFile(meta)
+	ioutil.WriteFile(meta, []byte(strings.Replace(string(data), `"clicks":"file",`, "", 1)), 0644)
+	if _, err := restoreSnapshot("one"); err != ErrSnapshotClicks {
+		t.Errorf("without the click store: got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// AdStore is where ads, slot rotations, advertiser membership and
+// impression counters live. The Redis implementation keeps the original
+// isu4:* key layout; the memory implementation needs nothing but the process.
+// Creatives themselves are kept in the AssetStore.
+type AdStore interface {
+	NextAdId() string
+
+	SaveAd(ad *Ad) error
+	UpdateAd(ad *Ad) error
+	GetAd(slot string, id string) *Ad
+	// GetAds returns the ads of the slot in the order of ids, nil for
+	// those that do not exist. Should the store fail, the ads it could not
+	// read are nil too, and the error says so.
+	GetAds(slot string, ids []string) ([]*Ad, error)
+	ExistsAd(slot string, id string) bool
+	// AdAdvertiser returns the advertiser of the ad, "" when there is no
+	// such ad.
+	AdAdvertiser(slot string, id string) string
+	DeleteAd(ad *Ad) error
+	// SetAdStatus changes the status of the ad and, in the same step, takes
+	// it out of the slot's ads or puts it back at the end. False if there is
+	// no such ad.
+	SetAdStatus(slot string, id string, status string) (bool, error)
+
+	CreateSlot(slot *Slot) (bool, error)
+	// UpdateSlot replaces a registered slot, false if there is none.
+	UpdateSlot(slot *Slot) (bool, error)
+	GetSlot(id string) *Slot
+	Slots() []*Slot
+
+	PushSlotAd(slot string, id string) error
+	SlotAds(slot string) []string
+	RemoveSlotAd(slot string, id string) error
+
+	AddAdvertiserAd(advrId string, slot string, id string) error
+	AdvertiserAds(advrId string) []*Ad
+
+	// IncrImpressions counts an impression of the ad and returns how many
+	// it has had, this one included.
+	IncrImpressions(slot string, id string, at time.Time) (int, error)
+	// ImpressionSeries returns impression counts per minute, keyed by the
+	// unix time the minute starts at.
+	ImpressionSeries(slot string, id string, from time.Time, to time.Time) map[int64]int
+
+	RecordView(viewer string, slot string, id string, at time.Time, window time.Duration) error
+	CountViews(viewer string, slot string, id string, since time.Time) int
+	// CountViewsEach is CountViews for each of the ads of the slot.
+	CountViewsEach(viewer string, slot string, ids []string, since time.Time) []int
+
+	// ClaimServe marks a serve as counted for kind and reports whether it
+	// was not before. The mark is kept for ttl.
+	ClaimServe(kind string, serve string, ttl time.Duration) bool
+
+	// SaveClick keeps a click for ttl so that a conversion can be tied to
+	// it by its ClickId.
+	SaveClick(click *ClickLog, ttl time.Duration) error
+	GetClick(clickId string) *ClickLog
+
+	// SaveProfile keeps a viewer's profile for ttl.
+	SaveProfile(viewerId string, profile *Profile, ttl time.Duration) error
+	GetProfile(viewerId string) *Profile
+	DeleteProfile(viewerId string) error
+
+	// Secret returns a random key every process sharing the store agrees
+	// on, made up the first time it is asked for. Flush, Snapshot and
+	// Restore leave secrets alone.
+	Secret(name string) ([]byte, error)
+
+	Flush() error
+	// Snapshot writes everything in the store to w in a form only Restore
+	// of the same kind of store reads back. Restore replaces the contents,
+	// leaving them alone if it cannot read the snapshot.
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+func newAdStore(kind string) AdStore {
+	switch kind {
+	case "memory":
+		return newMemoryStore()
+	case "redis":
+		return newRedisStore(redisOptions())
+	}
+	panic("unknown store: " + kind)
+}
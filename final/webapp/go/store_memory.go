@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	sync.Mutex
+
+	lastId      int64
+	ads         map[string]*Ad
+	daily       map[string]int
+	minutes     map[string]map[int64]int
+	slots       map[string][]string
+	slotInfos   map[string]*Slot
+	advertisers map[string]map[string]bool
+	views       map[string][]time.Time
+	serves      map[string]time.Time
+	clicks      map[string]*memoryClick
+	profiles    map[string]*memoryProfile
+
+	// secrets outlive Flush; nothing but this process shares them anyway.
+	secrets map[string][]byte
+}
+
+type memoryClick struct {
+	Click   ClickLog
+	Expires time.Time
+}
+
+type memoryProfile struct {
+	Profile Profile
+	Expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{secrets: map[string][]byte{}}
+	s.reset()
+	return s
+}
+
+func (s *memoryStore) reset() {
+	s.lastId = 0
+	s.ads = map[string]*Ad{}
+	s.daily = map[string]int{}
+	s.minutes = map[string]map[int64]int{}
+	s.slots = map[string][]string{}
+	s.slotInfos = map[string]*Slot{}
+	s.advertisers = map[string]map[string]bool{}
+	s.views = map[string][]time.Time{}
+	s.serves = map[string]time.Time{}
+	s.clicks = map[string]*memoryClick{}
+	s.profiles = map[string]*memoryProfile{}
+}
+
+func (s *memoryStore) NextAdId() string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastId++
+	return strconv.FormatInt(s.lastId, 10)
+}
+
+func (s *memoryStore) SaveAd(ad *Ad) error {
+	s.Lock()
+	defer s.Unlock()
+
+	saved := *ad
+	s.ads[adKey(ad.Slot, ad.Id)] = &saved
+	return nil
+}
+
+func (s *memoryStore) UpdateAd(ad *Ad) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := adKey(ad.Slot, ad.Id)
+	saved, exists := s.ads[key]
+	if !exists {
+		return nil
+	}
+	updated := *ad
+	updated.Impressions = saved.Impressions
+	s.ads[key] = &updated
+	return nil
+}
+
+func (s *memoryStore) GetAd(slot string, id string) *Ad {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.getAd(adKey(slot, id), impressionDay(time.Now()))
+}
+
+func (s *memoryStore) GetAds(slot string, ids []string) ([]*Ad, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ads := make([]*Ad, len(ids))
+	day := impressionDay(time.Now())
+	for i, id := range ids {
+		ads[i] = s.getAd(adKey(slot, id), day)
+	}
+	return ads, nil
+}
+
+// getAd returns a copy of the ad with its impressions on day. Callers
+// hold s.
+func (s *memoryStore) getAd(key string, day string) *Ad {
+	ad, exists := s.ads[key]
+	if !exists {
+		return nil
+	}
+	copied := *ad
+	copied.DailyImpressions = s.daily[key+":"+day]
+	return &copied
+}
+
+func (s *memoryStore) ExistsAd(slot string, id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, exists := s.ads[adKey(slot, id)]
+	return exists
+}
+
+func (s *memoryStore) AdAdvertiser(slot string, id string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	if ad, exists := s.ads[adKey(slot, id)]; exists {
+		return ad.Advertiser
+	}
+	return ""
+}
+
+func (s *memoryStore) DeleteAd(ad *Ad) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := adKey(ad.Slot, ad.Id)
+	delete(s.ads, key)
+	delete(s.minutes, key)
+	delete(s.advertisers[ad.Advertiser], key)
+	s.removeSlotAd(ad.Slot, ad.Id)
+	return nil
+}
+
+func (s *memoryStore) SetAdStatus(slot string, id string, status string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ad, exists := s.ads[adKey(slot, id)]
+	if !exists {
+		return false, nil
+	}
+	ad.Status = status
+	s.removeSlotAd(slot, id)
+	if status != AdStatusPaused {
+		s.slots[slot] = append(s.slots[slot], id)
+	}
+	return true, nil
+}
+
+func (s *memoryStore) CreateSlot(slot *Slot) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.slotInfos[slot.Id]; exists {
+		return false, nil
+	}
+	saved := *slot
+	s.slotInfos[slot.Id] = &saved
+	return true, nil
+}
+
+func (s *memoryStore) UpdateSlot(slot *Slot) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.slotInfos[slot.Id]; !exists {
+		return false, nil
+	}
+	saved := *slot
+	s.slotInfos[slot.Id] = &saved
+	return true, nil
+}
+
+func (s *memoryStore) GetSlot(id string) *Slot {
+	s.Lock()
+	defer s.Unlock()
+
+	slot, exists := s.slotInfos[id]
+	if !exists {
+		return nil
+	}
+	copied := *slot
+	return &copied
+}
+
+func (s *memoryStore) Slots() []*Slot {
+	s.Lock()
+	defer s.Unlock()
+
+	slots := []*Slot{}
+	for _, slot := range s.slotInfos {
+		copied := *slot
+		slots = append(slots, &copied)
+	}
+	return slots
+}
+
+func (s *memoryStore) PushSlotAd(slot string, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.slots[slot] = append(s.slots[slot], id)
+	return nil
+}
+
+func (s *memoryStore) SlotAds(slot string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string{}, s.slots[slot]...)
+}
+
+func (s *memoryStore) RemoveSlotAd(slot string, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeSlotAd(slot, id)
+	return nil
+}
+
+func (s *memoryStore) removeSlotAd(slot string, id string) {
+	ids := []string{}
+	for _, v := range s.slots[slot] {
+		if v != id {
+			ids = append(ids, v)
+		}
+	}
+	s.slots[slot] = ids
+}
+
+func (s *memoryStore) AddAdvertiserAd(advrId string, slot string, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.advertisers[advrId] == nil {
+		s.advertisers[advrId] = map[string]bool{}
+	}
+	s.advertisers[advrId][adKey(slot, id)] = true
+	return nil
+}
+
+func (s *memoryStore) AdvertiserAds(advrId string) []*Ad {
+	s.Lock()
+	defer s.Unlock()
+
+	ads := []*Ad{}
+	day := impressionDay(time.Now())
+	for key := range s.advertisers[advrId] {
+		if ad := s.getAd(key, day); ad != nil {
+			ads = append(ads, ad)
+		}
+	}
+	return ads
+}
+
+func (s *memoryStore) IncrImpressions(slot string, id string, at time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := adKey(slot, id)
+	if ad, exists := s.ads[key]; exists {
+		ad.Impressions++
+		day := impressionDay(at)
+		s.daily[key+":"+day]++
+		// Only today's count is ever read; earlier days go in bulk.
+		if len(s.daily) >= 1024 && len(s.daily)&(len(s.daily)-1) == 0 {
+			for k := range s.daily {
+				if !strings.HasSuffix(k, ":"+day) {
+					delete(s.daily, k)
+				}
+			}
+		}
+		minutes := s.minutes[key]
+		if minutes == nil {
+			minutes = map[int64]int{}
+			s.minutes[key] = minutes
+		}
+		minutes[minuteOf(at)]++
+
+		// As with serves, old minutes go in bulk as the map doubles.
+		if len(minutes) >= 1024 && len(minutes)&(len(minutes)-1) == 0 {
+			oldest := minuteOf(time.Now().Add(-seriesRetention))
+			for minute := range minutes {
+				if minute < oldest {
+					delete(minutes, minute)
+				}
+			}
+		}
+		return ad.Impressions, nil
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) ImpressionSeries(slot string, id string, from time.Time, to time.Time) map[int64]int {
+	s.Lock()
+	defer s.Unlock()
+
+	series := map[int64]int{}
+	if oldest := time.Now().Add(-seriesRetention); from.Before(oldest) {
+		from = oldest
+	}
+	for minute, n := range s.minutes[adKey(slot, id)] {
+		if minute >= minuteOf(from) && minute < to.Unix() {
+			series[minute] = n
+		}
+	}
+	return series
+}
+
+func (s *memoryStore) RecordView(viewer string, slot string, id string, at time.Time, window time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := viewer + ":" + adKey(slot, id)
+	views := []time.Time{}
+	for _, t := range s.views[key] {
+		if !t.Before(at.Add(-window)) {
+			views = append(views, t)
+		}
+	}
+	s.views[key] = append(views, at)
+	return nil
+}
+
+func (s *memoryStore) CountViews(viewer string, slot string, id string, since time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.countViews(viewer, adKey(slot, id), since)
+}
+
+func (s *memoryStore) CountViewsEach(viewer string, slot string, ids []string, since time.Time) []int {
+	s.Lock()
+	defer s.Unlock()
+
+	counts := make([]int, len(ids))
+	for i, id := range ids {
+		counts[i] = s.countViews(viewer, adKey(slot, id), since)
+	}
+	return counts
+}
+
+// countViews counts the views of the ad since then. Callers hold s.
+func (s *memoryStore) countViews(viewer string, key string, since time.Time) int {
+	n := 0
+	for _, t := range s.views[viewer+":"+key] {
+		if !t.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) ClaimServe(kind string, serve string, ttl time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	key := kind + ":" + serve
+	if expires, exists := s.serves[key]; exists && now.Before(expires) {
+		return false
+	}
+	s.serves[key] = now.Add(ttl)
+
+	// Marks are only dropped in bulk, once every time the map doubles.
+	if len(s.serves) >= 1024 && len(s.serves)&(len(s.serves)-1) == 0 {
+		for k, expires := range s.serves {
+			if !now.Before(expires) {
+				delete(s.serves, k)
+			}
+		}
+	}
+	return true
+}
+
+func (s *memoryStore) SaveClick(click *ClickLog, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.clicks[click.ClickId] = &memoryClick{*click, now.Add(ttl)}
+
+	// As with serves, expired clicks go in bulk as the map doubles.
+	if len(s.clicks) >= 1024 && len(s.clicks)&(len(s.clicks)-1) == 0 {
+		for k, c := range s.clicks {
+			if !now.Before(c.Expires) {
+				delete(s.clicks, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetClick(clickId string) *ClickLog {
+	s.Lock()
+	defer s.Unlock()
+
+	c, exists := s.clicks[clickId]
+	if !exists || !time.Now().Before(c.Expires) {
+		return nil
+	}
+	click := c.Click
+	return &click
+}
+
+func (s *memoryStore) SaveProfile(viewerId string, profile *Profile, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.profiles[viewerId] = &memoryProfile{*profile, now.Add(ttl)}
+
+	if len(s.profiles) >= 1024 && len(s.profiles)&(len(s.profiles)-1) == 0 {
+		for k, p := range s.profiles {
+			if !now.Before(p.Expires) {
+				delete(s.profiles, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetProfile(viewerId string) *Profile {
+	s.Lock()
+	defer s.Unlock()
+
+	p, exists := s.profiles[viewerId]
+	if !exists || !time.Now().Before(p.Expires) {
+		return nil
+	}
+	profile := p.Profile
+	return &profile
+}
+
+func (s *memoryStore) DeleteProfile(viewerId string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.profiles, viewerId)
+	return nil
+}
+
+func (s *memoryStore) Secret(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if secret, exists := s.secrets[name]; exists {
+		return secret, nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	s.secrets[name] = secret
+	return secret, nil
+}
+
+func (s *memoryStore) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.reset()
+	return nil
+}
+
+// memorySnapshot mirrors memoryStore with exported fields for gob, which
+// unlike JSON keeps fields such as Ad.AssetHash.
+type memorySnapshot struct {
+	LastId      int64
+	Ads         map[string]*Ad
+	Daily       map[string]int
+	Minutes     map[string]map[int64]int
+	Slots       map[string][]string
+	SlotInfos   map[string]*Slot
+	Advertisers map[string]map[string]bool
+	Views       map[string][]time.Time
+	Serves      map[string]time.Time
+	Clicks      map[string]*memoryClick
+	Profiles    map[string]*memoryProfile
+}
+
+func (s *memoryStore) Snapshot(w io.Writer) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return gob.NewEncoder(w).Encode(&memorySnapshot{
+		s.lastId, s.ads, s.daily, s.minutes, s.slots, s.slotInfos, s.advertisers, s.views, s.serves, s.clicks, s.profiles,
+	})
+}
+
+func (s *memoryStore) Restore(r io.Reader) error {
+	// Decoding into fresh maps leaves empty ones, which gob does not send,
+	// non-nil.
+	fresh := newMemoryStore()
+	snap := &memorySnapshot{
+		0, fresh.ads, fresh.daily, fresh.minutes, fresh.slots, fresh.slotInfos, fresh.advertisers, fresh.views, fresh.serves, fresh.clicks, fresh.profiles,
+	}
+	if err := gob.NewDecoder(r).Decode(snap); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastId = snap.LastId
+	s.ads, s.daily, s.minutes = snap.Ads, snap.Daily, snap.Minutes
+	s.slots, s.slotInfos, s.advertisers = snap.Slots, snap.SlotInfos, snap.Advertisers
+	s.views, s.serves, s.clicks = snap.Views, snap.Serves, snap.Clicks
+	s.profiles = snap.Profiles
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"time"
+)
+
+// meteredStore times every call into the AdStore it wraps. Snapshot and
+// Restore are admin operations and pass through untimed.
+type meteredStore struct {
+	AdStore
+
+	kind string
+}
+
+func newMeteredStore(s AdStore, kind string) *meteredStore {
+	return &meteredStore{s, kind}
+}
+
+func (s *meteredStore) observe(op string, start time.Time) {
+	observeStore(s.kind, op, start)
+}
+
+func (s *meteredStore) NextAdId() string {
+	defer s.observe("NextAdId", time.Now())
+	return s.AdStore.NextAdId()
+}
+
+func (s *meteredStore) SaveAd(ad *Ad) error {
+	defer s.observe("SaveAd", time.Now())
+	return s.AdStore.SaveAd(ad)
+}
+
+func (s *meteredStore) UpdateAd(ad *Ad) error {
+	defer s.observe("UpdateAd", time.Now())
+	return s.AdStore.UpdateAd(ad)
+}
+
+func (s *meteredStore) GetAd(slot string, id string) *Ad {
+	defer s.observe("GetAd", time.Now())
+	return s.AdStore.GetAd(slot, id)
+}
+
+func (s *meteredStore) GetAds(slot string, ids []string) ([]*Ad, error) {
+	defer s.observe("GetAds", time.Now())
+	return s.AdStore.GetAds(slot, ids)
+}
+
+func (s *meteredStore) ExistsAd(slot string, id string) bool {
+	defer s.observe("ExistsAd", time.Now())
+	return s.AdStore.ExistsAd(slot, id)
+}
+
+func (s *meteredStore) AdAdvertiser(slot string, id string) string {
+	defer s.observe("AdAdvertiser", time.Now())
+	return s.AdStore.AdAdvertiser(slot, id)
+}
+
+func (s *meteredStore) DeleteAd(ad *Ad) error {
+	defer s.observe("DeleteAd", time.Now())
+	return s.AdStore.DeleteAd(ad)
+}
+
+func (s *meteredStore) SetAdStatus(slot string, id string, status string) (bool, error) {
+	defer s.observe("SetAdStatus", time.Now())
+	return s.AdStore.SetAdStatus(slot, id, status)
+}
+
+func (s *meteredStore) CreateSlot(slot *Slot) (bool, error) {
+	defer s.observe("CreateSlot", time.Now())
+	return s.AdStore.CreateSlot(slot)
+}
+
+func (s *meteredStore) UpdateSlot(slot *Slot) (bool, error) {
+	defer s.observe("UpdateSlot", time.Now())
+	return s.AdStore.UpdateSlot(slot)
+}
+
+func (s *meteredStore) GetSlot(id string) *Slot {
+	defer s.observe("GetSlot", time.Now())
+	return s.AdStore.GetSlot(id)
+}
+
+func (s *meteredStore) Slots() []*Slot {
+	defer s.observe("Slots", time.Now())
+	return s.AdStore.Slots()
+}
+
+func (s *meteredStore) PushSlotAd(slot string, id string) error {
+	defer s.observe("PushSlotAd", time.Now())
+	return s.AdStore.PushSlotAd(slot, id)
+}
+
+func (s *meteredStore) SlotAds(slot string) []string {
+	defer s.observe("SlotAds", time.Now())
+	return s.AdStore.SlotAds(slot)
+}
+
+func (s *meteredStore) RemoveSlotAd(slot string, id string) error {
+	defer s.observe("RemoveSlotAd", time.Now())
+	return s.AdStore.RemoveSlotAd(slot, id)
+}
+
+func (s *meteredStore) AddAdvertiserAd(advrId string, slot string, id string) error {
+	defer s.observe("AddAdvertiserAd", time.Now())
+	return s.AdStore.AddAdvertiserAd(advrId, slot, id)
+}
+
+func (s *meteredStore) AdvertiserAds(advrId string) []*Ad {
+	defer s.observe("AdvertiserAds", time.Now())
+	return s.AdStore.AdvertiserAds(advrId)
+}
+
+func (s *meteredStore) IncrImpressions(slot string, id string, at time.Time) (int, error) {
+	defer s.observe("IncrImpressions", time.Now())
+	return s.AdStore.IncrImpressions(slot, id, at)
+}
+
+func (s *meteredStore) ImpressionSeries(slot string, id string, from time.Time, to time.Time) map[int64]int {
+	defer s.observe("ImpressionSeries", time.Now())
+	return s.AdStore.ImpressionSeries(slot, id, from, to)
+}
+
+func (s *meteredStore) RecordView(viewer string, slot string, id string, at time.Time, window time.Duration) error {
+	defer s.observe("RecordView", time.Now())
+	return s.AdStore.RecordView(viewer, slot, id, at, window)
+}
+
+func (s *meteredStore) CountViews(viewer string, slot string, id string, since time.Time) int {
+	defer s.observe("CountViews", time.Now())
+	return s.AdStore.CountViews(viewer, slot, id, since)
+}
+
+func (s *meteredStore) CountViewsEach(viewer string, slot string, ids []string, since time.Time) []int {
+	defer s.observe("CountViewsEach", time.Now())
+	return s.AdStore.CountViewsEach(viewer, slot, ids, since)
+}
+
+func (s *meteredStore) ClaimServe(kind string, serve string, ttl time.Duration) bool {
+	defer s.observe("ClaimServe", time.Now())
+	return s.AdStore.ClaimServe(kind, serve, ttl)
+}
+
+func (s *meteredStore) SaveClick(click *ClickLog, ttl time.Duration) error {
+	defer s.observe("SaveClick", time.Now())
+	return s.AdStore.SaveClick(click, ttl)
+}
+
+func (s *meteredStore) GetClick(clickId string) *ClickLog {
+	defer s.observe("GetClick", time.Now())
+	return s.AdStore.GetClick(clickId)
+}
+
+func (s *meteredStore) SaveProfile(viewerId string, profile *Profile, ttl time.Duration) error {
+	defer s.observe("SaveProfile", time.Now())
+	return s.AdStore.SaveProfile(viewerId, profile, ttl)
+}
+
+func (s *meteredStore) GetProfile(viewerId string) *Profile {
+	defer s.observe("GetProfile", time.Now())
+	return s.AdStore.GetProfile(viewerId)
+}
+
+func (s *meteredStore) DeleteProfile(viewerId string) error {
+	defer s.observe("DeleteProfile", time.Now())
+	return s.AdStore.DeleteProfile(viewerId)
+}
+
+func (s *meteredStore) Flush() error {
+	defer s.observe("Flush", time.Now())
+	return s.AdStore.Flush()
+}
+
+// meteredClickStore times the ClickStore it wraps the same way, as store
+// KIND-clicks.
+type meteredClickStore struct {
+	ClickStore
+
+	kind string
+}
+
+func newMeteredClickStore(s ClickStore, kind string) *meteredClickStore {
+	return &meteredClickStore{s, kind + "-clicks"}
+}
+
+func (s *meteredClickStore) observe(op string, start time.Time) {
+	observeStore(s.kind, op, start)
+}
+
+func (s *meteredClickStore) Record(advrId string, click *ClickLog) (int, error) {
+	defer s.observe("Record", time.Now())
+	return s.ClickStore.Record(advrId, click)
+}
+
+func (s *meteredClickStore) Aggregates(advrId string, with int) (map[string]*ClickAggregate, error) {
+	defer s.observe("Aggregates", time.Now())
+	return s.ClickStore.Aggregates(advrId, with)
+}
+
+func (s *meteredClickStore) Clear() error {
+	defer s.observe("Clear", time.Now())
+	return s.ClickStore.Clear()
+}
+
+func (s *meteredClickStore) Reload() {
+	defer s.observe("Reload", time.Now())
+	s.ClickStore.Reload()
+}
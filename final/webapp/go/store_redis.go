@@ -0,0 +1,723 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+type redisStore struct {
+	rd *redis.Client
+}
+
+func newRedisStore(opts *redis.Options) *redisStore {
+	return &redisStore{
+		rd: redis.NewClient(opts),
+	}
+}
+
+// redisOptions reads the connection settings:
+//
+//	ISU4_REDIS_ADDR      host:port, or unix:/path/to/redis.sock
+//	ISU4_REDIS_PASSWORD  AUTH password
+//	ISU4_REDIS_DB        database number
+//	ISU4_REDIS_POOL_SIZE connections kept per process
+//	ISU4_REDIS_DIAL_TIMEOUT
+//	ISU4_REDIS_TIMEOUT   read and write timeout, 0 for none
+func redisOptions() *redis.Options {
+	opts := &redis.Options{
+		Network:  "tcp",
+		Addr:     getEnv("ISU4_REDIS_ADDR", "localhost:6379"),
+		Password: getEnv("ISU4_REDIS_PASSWORD", ""),
+	}
+	if strings.HasPrefix(opts.Addr, "unix:") {
+		opts.Network, opts.Addr = "unix", strings.TrimPrefix(opts.Addr, "unix:")
+	}
+
+	db, err := strconv.ParseInt(getEnv("ISU4_REDIS_DB", "0"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	opts.DB = db
+	if opts.PoolSize, err = strconv.Atoi(getEnv("ISU4_REDIS_POOL_SIZE", "10")); err != nil {
+		panic(err)
+	}
+	if opts.DialTimeout, err = time.ParseDuration(getEnv("ISU4_REDIS_DIAL_TIMEOUT", "5s")); err != nil {
+		panic(err)
+	}
+	timeout, err := time.ParseDuration(getEnv("ISU4_REDIS_TIMEOUT", "0"))
+	if err != nil {
+		panic(err)
+	}
+	opts.ReadTimeout, opts.WriteTimeout = timeout, timeout
+	return opts
+}
+
+func adKey(slot string, id string) string {
+	return "isu4:ad:" + slot + "-" + id
+}
+
+// dailyImpressionsKey counts the impressions of the ad, by its key, on
+// one day. It expires once the day is well over.
+func dailyImpressionsKey(adKey string, day string) string {
+	return "isu4:daily:" + strings.TrimPrefix(adKey, "isu4:ad:") + ":" + day
+}
+
+const dailyImpressionsTTL = 48 * time.Hour
+
+func advertiserKey(id string) string {
+	return "isu4:advertiser:" + id
+}
+
+func slotKey(slot string) string {
+	return "isu4:slot:" + slot
+}
+
+func slotInfoKey(slot string) string {
+	return "isu4:slot-info:" + slot
+}
+
+// impressionsKey is the hash of the impressions per minute within one
+// hour, which expires seriesRetention after it was last counted into.
+func impressionsKey(slot string, id string, hour int64) string {
+	return "isu4:impressions:" + slot + "-" + id + ":" + strconv.FormatInt(hour, 10)
+}
+
+func viewsKey(viewer string, slot string, id string) string {
+	return "isu4:views:" + viewer + ":" + slot + "-" + id
+}
+
+func serveKey(kind string, serve string) string {
+	return "isu4:serve:" + kind + ":" + serve
+}
+
+func clickKey(clickId string) string {
+	return "isu4:click:" + clickId
+}
+
+func profileKey(viewerId string) string {
+	return "isu4:profile:" + viewerId
+}
+
+const secretKeyPrefix = "isu4:secret:"
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func adFromHash(m map[string]string) *Ad {
+	if m == nil {
+		return nil
+	}
+	if _, exists := m["id"]; !exists {
+		return nil
+	}
+
+	imp, _ := strconv.Atoi(m["impressions"])
+	status := m["status"]
+	if status == "" {
+		status = AdStatusActive
+	}
+	weight, _ := strconv.Atoi(m["weight"])
+	if weight < 1 {
+		weight = 1
+	}
+	impCap, _ := strconv.Atoi(m["impression_cap"])
+	dailyCap, _ := strconv.Atoi(m["daily_impression_cap"])
+	return &Ad{
+		Slot:        m["slot"],
+		Id:          m["id"],
+		Title:       m["title"],
+		Type:        m["type"],
+		Advertiser:  m["advertiser"],
+		Destination: m["destination"],
+		Impressions: imp,
+		AssetHash:   m["asset"],
+		Status:      status,
+
+		Weight:             weight,
+		ImpressionCap:      impCap,
+		DailyImpressionCap: dailyCap,
+
+		Targeting: Targeting{
+			splitList(m["target_gender"]),
+			splitList(m["target_generation"]),
+			splitList(m["target_agent"]),
+		},
+		Media: mediaFromHash(m),
+	}
+}
+
+func mediaFromHash(m map[string]string) *MediaInfo {
+	if m["media_type"] == "" {
+		return nil
+	}
+	duration, _ := strconv.ParseFloat(m["media_duration"], 64)
+	width, _ := strconv.Atoi(m["media_width"])
+	height, _ := strconv.Atoi(m["media_height"])
+	size, _ := strconv.ParseInt(m["media_size"], 10, 64)
+	return &MediaInfo{m["media_type"], duration, width, height, size}
+}
+
+// adFields is every attribute of the ad hash except its counters.
+func adFields(ad *Ad) []string {
+	return []string{
+		"slot", ad.Slot,
+		"id", ad.Id,
+		"title", ad.Title,
+		"type", ad.Type,
+		"advertiser", ad.Advertiser,
+		"destination", ad.Destination,
+		"asset", ad.AssetHash,
+		"status", ad.Status,
+		"weight", strconv.Itoa(ad.Weight),
+		"impression_cap", strconv.Itoa(ad.ImpressionCap),
+		"daily_impression_cap", strconv.Itoa(ad.DailyImpressionCap),
+		"target_gender", strings.Join(ad.Targeting.Genders, ","),
+		"target_generation", strings.Join(ad.Targeting.Generations, ","),
+		"target_agent", strings.Join(ad.Targeting.Agents, ","),
+	}
+}
+
+func (s *redisStore) NextAdId() string {
+	id, _ := s.rd.Incr("isu4:ad-next").Result()
+	return strconv.FormatInt(id, 10)
+}
+
+func (s *redisStore) SaveAd(ad *Ad) error {
+	fields := append(adFields(ad), "impressions", strconv.Itoa(ad.Impressions))
+	if media := ad.Media; media != nil {
+		fields = append(fields,
+			"media_type", media.Type,
+			"media_duration", strconv.FormatFloat(media.Duration, 'f', -1, 64),
+			"media_width", strconv.Itoa(media.Width),
+			"media_height", strconv.Itoa(media.Height),
+			"media_size", strconv.FormatInt(media.Size, 10),
+		)
+	}
+	return s.rd.HMSet(adKey(ad.Slot, ad.Id), fields[0], fields[1], fields[2:]...).Err()
+}
+
+// UpdateAd leaves an ad deleted meanwhile deleted, as the memory store
+// does: the HMSET only goes through if the hash still exists, and is tried
+// again if it changed in between.
+func (s *redisStore) UpdateAd(ad *Ad) error {
+	key := adKey(ad.Slot, ad.Id)
+	fields := adFields(ad)
+	multi := s.rd.Multi()
+	defer multi.Close()
+	for {
+		if err := multi.Watch(key).Err(); err != nil {
+			return err
+		}
+		exists, err := multi.Exists(key).Result()
+		if err != nil || !exists {
+			multi.Unwatch()
+			return err
+		}
+		_, err = multi.Exec(func() error {
+			multi.HMSet(key, fields[0], fields[1], fields[2:]...)
+			return nil
+		})
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+func (s *redisStore) GetAd(slot string, id string) *Ad {
+	ads, _ := s.getAds(adKey(slot, id))
+	return ads[0]
+}
+
+func (s *redisStore) GetAds(slot string, ids []string) ([]*Ad, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = adKey(slot, id)
+	}
+	return s.getAds(keys...)
+}
+
+// getAds reads the ads and their impressions today in one pipeline. Ads
+// that do not exist, or could not be read, are nil; the error tells the
+// latter apart.
+func (s *redisStore) getAds(keys ...string) ([]*Ad, error) {
+	ads := make([]*Ad, len(keys))
+	if len(keys) == 0 {
+		return ads, nil
+	}
+
+	day := impressionDay(time.Now())
+	pipe := s.rd.Pipeline()
+	defer pipe.Close()
+	hashes := make([]*redis.StringStringMapCmd, len(keys))
+	dailies := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		hashes[i] = pipe.HGetAllMap(key)
+		dailies[i] = pipe.Get(dailyImpressionsKey(key, day))
+	}
+	// A missing daily count fails its GET with redis.Nil; the others are
+	// checked one by one.
+	pipe.Exec()
+
+	var failed error
+	for i := range keys {
+		m, err := hashes[i].Result()
+		if err != nil {
+			failed = err
+			continue
+		}
+		ad := adFromHash(m)
+		if ad == nil {
+			continue
+		}
+		// Without its count today the daily cap could not be checked.
+		daily, err := dailies[i].Int64()
+		if err != nil && err != redis.Nil {
+			failed = err
+			continue
+		}
+		ad.DailyImpressions = int(daily)
+		ads[i] = ad
+	}
+	return ads, failed
+}
+
+func (s *redisStore) ExistsAd(slot string, id string) bool {
+	exists, _ := s.rd.Exists(adKey(slot, id)).Result()
+	return exists
+}
+
+func (s *redisStore) AdAdvertiser(slot string, id string) string {
+	advrId, _ := s.rd.HGet(adKey(slot, id), "advertiser").Result()
+	return advrId
+}
+
+func (s *redisStore) DeleteAd(ad *Ad) error {
+	// The impressions per minute are left to expire: ad IDs are never
+	// reused, and finding every hour would take a SCAN.
+	key := adKey(ad.Slot, ad.Id)
+	multi := s.rd.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.LRem(slotKey(ad.Slot), 0, ad.Id)
+		multi.SRem(advertiserKey(ad.Advertiser), key)
+		multi.Del(key)
+		return nil
+	})
+	return err
+}
+
+// SetAdStatus watches the hash as UpdateAd does, so that an ad deleted
+// meanwhile is not put back in the slot. The LREM before the RPUSH keeps
+// the ad in the slot once however many times it is resumed.
+func (s *redisStore) SetAdStatus(slot string, id string, status string) (bool, error) {
+	key := adKey(slot, id)
+	multi := s.rd.Multi()
+	defer multi.Close()
+	for {
+		if err := multi.Watch(key).Err(); err != nil {
+			return false, err
+		}
+		exists, err := multi.Exists(key).Result()
+		if err != nil || !exists {
+			multi.Unwatch()
+			return false, err
+		}
+		_, err = multi.Exec(func() error {
+			multi.HSet(key, "status", status)
+			multi.LRem(slotKey(slot), 0, id)
+			if status != AdStatusPaused {
+				multi.RPush(slotKey(slot), id)
+			}
+			return nil
+		})
+		if err != redis.TxFailedErr {
+			return err == nil, err
+		}
+	}
+}
+
+func (s *redisStore) CreateSlot(slot *Slot) (bool, error) {
+	added, err := s.rd.SAdd("isu4:slots", slot.Id).Result()
+	if err != nil || added == 0 {
+		return false, err
+	}
+	err = s.saveSlot(slot)
+	return err == nil, err
+}
+
+func (s *redisStore) UpdateSlot(slot *Slot) (bool, error) {
+	registered, err := s.rd.SIsMember("isu4:slots", slot.Id).Result()
+	if err != nil || !registered {
+		return false, err
+	}
+	err = s.saveSlot(slot)
+	return err == nil, err
+}
+
+func (s *redisStore) saveSlot(slot *Slot) error {
+	return s.rd.HMSet(slotInfoKey(slot.Id),
+		"id", slot.Id,
+		"owner", slot.Owner,
+		"publisher", slot.Publisher,
+		"width", strconv.Itoa(slot.Width),
+		"height", strconv.Itoa(slot.Height),
+		"mime_types", strings.Join(slot.MimeTypes, ","),
+		"max_asset_size", strconv.FormatInt(slot.MaxAssetSize, 10),
+	).Err()
+}
+
+func (s *redisStore) GetSlot(id string) *Slot {
+	m, _ := s.rd.HGetAllMap(slotInfoKey(id)).Result()
+	if m == nil || m["id"] == "" {
+		return nil
+	}
+	width, _ := strconv.Atoi(m["width"])
+	height, _ := strconv.Atoi(m["height"])
+	maxSize, _ := strconv.ParseInt(m["max_asset_size"], 10, 64)
+	return &Slot{
+		Id:           m["id"],
+		Owner:        m["owner"],
+		Publisher:    m["publisher"],
+		Width:        width,
+		Height:       height,
+		MimeTypes:    splitList(m["mime_types"]),
+		MaxAssetSize: maxSize,
+	}
+}
+
+func (s *redisStore) Slots() []*Slot {
+	slots := []*Slot{}
+	ids, _ := s.rd.SMembers("isu4:slots").Result()
+	for _, id := range ids {
+		if slot := s.GetSlot(id); slot != nil {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+func (s *redisStore) PushSlotAd(slot string, id string) error {
+	return s.rd.RPush(slotKey(slot), id).Err()
+}
+
+func (s *redisStore) SlotAds(slot string) []string {
+	ids, _ := s.rd.LRange(slotKey(slot), 0, -1).Result()
+	return ids
+}
+
+func (s *redisStore) RemoveSlotAd(slot string, id string) error {
+	return s.rd.LRem(slotKey(slot), 0, id).Err()
+}
+
+func (s *redisStore) AddAdvertiserAd(advrId string, slot string, id string) error {
+	return s.rd.SAdd(advertiserKey(advrId), adKey(slot, id)).Err()
+}
+
+func (s *redisStore) AdvertiserAds(advrId string) []*Ad {
+	ads := []*Ad{}
+	adKeys, _ := s.rd.SMembers(advertiserKey(advrId)).Result()
+	all, _ := s.getAds(adKeys...)
+	for _, ad := range all {
+		if ad != nil {
+			ads = append(ads, ad)
+		}
+	}
+	return ads
+}
+
+func (s *redisStore) IncrImpressions(slot string, id string, at time.Time) (int, error) {
+	key := adKey(slot, id)
+	daily := dailyImpressionsKey(key, impressionDay(at))
+	minutes := impressionsKey(slot, id, hourOf(at))
+	multi := s.rd.Multi()
+	defer multi.Close()
+	var total *redis.IntCmd
+	_, err := multi.Exec(func() error {
+		total = multi.HIncrBy(key, "impressions", 1)
+		multi.Incr(daily)
+		multi.Expire(daily, dailyImpressionsTTL)
+		multi.HIncrBy(minutes, strconv.FormatInt(minuteOf(at), 10), 1)
+		multi.Expire(minutes, seriesRetention)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(total.Val()), nil
+}
+
+// ImpressionSeries asks each hour in the range for just the minutes in
+// the range, all in one pipeline.
+func (s *redisStore) ImpressionSeries(slot string, id string, from time.Time, to time.Time) map[int64]int {
+	series := map[int64]int{}
+	if oldest := time.Now().Add(-seriesRetention); from.Before(oldest) {
+		from = oldest
+	}
+	first, last := minuteOf(from), to.Unix()
+	if first >= last {
+		return series
+	}
+
+	type hourCmd struct {
+		minutes []int64
+		cmd     *redis.SliceCmd
+	}
+	pipe := s.rd.Pipeline()
+	defer pipe.Close()
+	cmds := []hourCmd{}
+	for hour := first - first%3600; hour < last; hour += 3600 {
+		minutes, fields := []int64{}, []string{}
+		for minute := hour; minute < hour+3600 && minute < last; minute += 60 {
+			if minute >= first {
+				minutes = append(minutes, minute)
+				fields = append(fields, strconv.FormatInt(minute, 10))
+			}
+		}
+		cmds = append(cmds, hourCmd{minutes, pipe.HMGet(impressionsKey(slot, id, hour), fields...)})
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return series
+	}
+
+	for _, c := range cmds {
+		for i, v := range c.cmd.Val() {
+			if v, ok := v.(string); ok {
+				n, _ := strconv.Atoi(v)
+				series[c.minutes[i]] = n
+			}
+		}
+	}
+	return series
+}
+
+func (s *redisStore) RecordView(viewer string, slot string, id string, at time.Time, window time.Duration) error {
+	key := viewsKey(viewer, slot, id)
+	s.rd.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(at.Add(-window).UnixNano(), 10))
+	s.rd.ZAdd(key, redis.Z{Score: float64(at.UnixNano()), Member: strconv.FormatInt(at.UnixNano(), 10)})
+	return s.rd.Expire(key, window).Err()
+}
+
+func (s *redisStore) CountViews(viewer string, slot string, id string, since time.Time) int {
+	n, _ := s.rd.ZCount(viewsKey(viewer, slot, id), strconv.FormatInt(since.UnixNano(), 10), "+inf").Result()
+	return int(n)
+}
+
+func (s *redisStore) CountViewsEach(viewer string, slot string, ids []string, since time.Time) []int {
+	counts := make([]int, len(ids))
+	if len(ids) == 0 {
+		return counts
+	}
+	pipe := s.rd.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.ZCount(viewsKey(viewer, slot, id), strconv.FormatInt(since.UnixNano(), 10), "+inf")
+	}
+	pipe.Exec()
+	for i, cmd := range cmds {
+		counts[i] = int(cmd.Val())
+	}
+	return counts
+}
+
+func (s *redisStore) ClaimServe(kind string, serve string, ttl time.Duration) bool {
+	claimed, err := s.rd.SetNX(serveKey(kind, serve), "1", ttl).Result()
+	return err == nil && claimed
+}
+
+// eachKeys hands every isu4:* key but the secrets to fn a SCAN batch at a
+// time, so that a large data set never blocks Redis the way KEYS does.
+func (s *redisStore) eachKeys(fn func(keys []string) error) error {
+	cursor := int64(0)
+	for {
+		next, scanned, err := s.rd.Scan(cursor, "isu4:*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		keys := scanned[:0]
+		for _, key := range scanned {
+			if !strings.HasPrefix(key, secretKeyPrefix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			if err = fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s *redisStore) SaveClick(click *ClickLog, ttl time.Duration) error {
+	key := clickKey(click.ClickId)
+	multi := s.rd.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.HMSet(key,
+			"slot", click.Slot,
+			"id", click.AdId,
+			"advertiser", click.Advertiser,
+			"user", click.User,
+			"agent", click.Agent,
+			"at", strconv.FormatInt(click.At.Unix(), 10),
+			"invalid", click.Invalid,
+		)
+		multi.Expire(key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) GetClick(clickId string) *ClickLog {
+	m, _ := s.rd.HGetAllMap(clickKey(clickId)).Result()
+	if len(m) == 0 {
+		return nil
+	}
+	sec, _ := strconv.ParseInt(m["at"], 10, 64)
+	return &ClickLog{
+		AdId:       m["id"],
+		User:       m["user"],
+		Agent:      m["agent"],
+		At:         time.Unix(sec, 0),
+		Invalid:    m["invalid"],
+		ClickId:    clickId,
+		Slot:       m["slot"],
+		Advertiser: m["advertiser"],
+	}
+}
+
+func (s *redisStore) SaveProfile(viewerId string, profile *Profile, ttl time.Duration) error {
+	key := profileKey(viewerId)
+	multi := s.rd.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.HMSet(key,
+			"gender", profile.Gender,
+			"age", strconv.Itoa(profile.Age),
+			"updated_at", strconv.FormatInt(profile.UpdatedAt.Unix(), 10),
+		)
+		multi.Expire(key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) GetProfile(viewerId string) *Profile {
+	m, _ := s.rd.HGetAllMap(profileKey(viewerId)).Result()
+	if len(m) == 0 {
+		return nil
+	}
+	age, _ := strconv.Atoi(m["age"])
+	sec, _ := strconv.ParseInt(m["updated_at"], 10, 64)
+	return &Profile{m["gender"], age, time.Unix(sec, 0)}
+}
+
+func (s *redisStore) DeleteProfile(viewerId string) error {
+	return s.rd.Del(profileKey(viewerId)).Err()
+}
+
+// Secret is kept hex encoded. Whichever process gets there first sets it;
+// everyone reads back what it set.
+func (s *redisStore) Secret(name string) ([]byte, error) {
+	key := secretKeyPrefix + name
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	if err := s.rd.SetNX(key, hex.EncodeToString(buf), 0).Err(); err != nil {
+		return nil, err
+	}
+	secret, err := s.rd.Get(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(secret)
+}
+
+func (s *redisStore) Flush() error {
+	return s.eachKeys(func(keys []string) error {
+		return s.rd.Del(keys...).Err()
+	})
+}
+
+// redisSnapshotEntry is one key of a snapshot in the DUMP serialization,
+// written one JSON object per line.
+type redisSnapshotEntry struct {
+	Key   string        `json:"key"`
+	TTL   time.Duration `json:"ttl"`
+	Value []byte        `json:"value"`
+}
+
+func (s *redisStore) Snapshot(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return s.eachKeys(func(keys []string) error {
+		for _, key := range keys {
+			value, err := s.rd.Dump(key).Result()
+			if err == redis.Nil {
+				// Expired since the scan.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ttl, err := s.rd.PTTL(key).Result()
+			if err != nil {
+				return err
+			}
+			if ttl < 0 {
+				ttl = 0
+			}
+			if err = enc.Encode(&redisSnapshotEntry{key, ttl, []byte(value)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Restore reads the whole snapshot before flushing, so that one it cannot
+// read leaves the keys as they were.
+func (s *redisStore) Restore(r io.Reader) error {
+	entries := []*redisSnapshotEntry{}
+	dec := json.NewDecoder(r)
+	for {
+		entry := &redisSnapshotEntry{}
+		err := dec.Decode(entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(entry.Key, "isu4:") || len(entry.Value) == 0 || entry.TTL < 0 {
+			return errors.New("invalid snapshot entry: " + entry.Key)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.rd.Restore(entry.Key, entry.TTL, string(entry.Value)).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreAds(t *testing.T) {
+	s := newMemoryStore()
+	ad := &Ad{Slot: "s", Id: s.NextAdId(), Advertiser: "a", Title: "one", Weight: 1}
+	s.SaveAd(ad)
+	s.PushSlotAd("s", ad.Id)
+	s.AddAdvertiserAd("a", "s", ad.Id)
+	s.IncrImpressions("s", ad.Id, time.Now())
+
+	ad.Title = "two"
+	s.UpdateAd(ad)
+	got := s.GetAd("s", ad.Id)
+	if got == nil || got.Title != "two" || got.Impressions != 1 || got.DailyImpressions != 1 {
+		t.Fatalf("got %+v", got)
+	}
+
+	ads, err := s.GetAds("s", []string{"9", ad.Id})
+	if err != nil || len(ads) != 2 || ads[0] != nil || ads[1] == nil || ads[1].Id != ad.Id {
+		t.Errorf("GetAds: got %v", ads)
+	}
+	if advrId := s.AdAdvertiser("s", ad.Id); advrId != "a" {
+		t.Errorf("AdAdvertiser: got %q", advrId)
+	}
+
+	s.DeleteAd(got)
+	s.UpdateAd(ad)
+	if s.ExistsAd("s", ad.Id) || len(s.SlotAds("s")) != 0 || len(s.AdvertiserAds("a")) != 0 {
+		t.Error("the ad outlived DeleteAd")
+	}
+}
+
+func TestMemoryStoreFlushAndRestore(t *testing.T) {
+	s := newMemoryStore()
+	secret, _ := s.Secret("serve")
+	s.SaveAd(&Ad{Slot: "s", Id: s.NextAdId()})
+	s.PushSlotAd("s", "1")
+
+	buf := &bytes.Buffer{}
+	if err := s.Snapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Flush()
+	if s.ExistsAd("s", "1") || s.NextAdId() != "1" {
+		t.Error("Flush left the ad")
+	}
+	if after, _ := s.Secret("serve"); !bytes.Equal(secret, after) {
+		t.Error("Flush changed the secret")
+	}
+
+	if err := s.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2])); err == nil {
+		t.Error("a truncated snapshot restored")
+	}
+	if err := s.Restore(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ExistsAd("s", "1") || len(s.SlotAds("s")) != 1 || s.NextAdId() != "2" {
+		t.Error("Restore did not bring the ad back")
+	}
+}
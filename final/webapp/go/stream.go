@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// GET /me/report/stream is a Server-Sent Events stream of the advertiser's
+// report. It starts with one "report" event per ad, as in the ndjson
+// report, and goes on with a "delta" event for every impression, billable
+// click and conversion as it is counted.
+//
+// Deltas are fanned out through a ReportBroker, picked by
+// ISU4_REPORT_PUBSUB: "local" reaches the streams of this process only,
+// "redis" the streams of every app server sharing the Redis. Nothing is
+// published for an advertiser nobody streams.
+//
+// Each delta carries the total its count came to, as the store returned
+// it. A stream subscribes before it reads the report and leaves out the
+// deltas whose totals the report already shows, so that none is counted
+// twice or missed.
+
+type ReportDelta struct {
+	Slot        string    `json:"slot"`
+	AdId        string    `json:"ad_id"`
+	Impressions int       `json:"impressions,omitempty"`
+	Clicks      int       `json:"clicks,omitempty"`
+	Conversions int       `json:"conversions,omitempty"`
+	Total       int       `json:"total"`
+	At          time.Time `json:"at"`
+}
+
+type ReportBroker interface {
+	// Publish hands the delta to the advertiser's subscribers, if there
+	// are any.
+	Publish(advrId string, delta *ReportDelta)
+	// Subscribe returns the deltas for the advertiser. The channel is
+	// closed when the subscriber falls too far behind; cancel ends the
+	// subscription.
+	Subscribe(advrId string) (deltas <-chan *ReportDelta, cancel func())
+}
+
+var reportBroker = newReportBroker(getEnv("ISU4_REPORT_PUBSUB", "local"))
+
+func newReportBroker(kind string) ReportBroker {
+	switch kind {
+	case "local":
+		return newLocalBroker()
+	case "redis":
+		return newRedisBroker(redis.NewClient(redisOptions()))
+	}
+	panic("unknown report pubsub: " + kind)
+}
+
+// subscriberBuffer is how many deltas a stream may lag behind before it is
+// dropped. Its client reconnects and starts over from a fresh report.
+const subscriberBuffer = 256
+
+type localBroker struct {
+	sync.Mutex
+
+	subscribers map[string]map[chan *ReportDelta]bool
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{
+		subscribers: map[string]map[chan *ReportDelta]bool{},
+	}
+}
+
+// inReport tells whether the count of the delta is in the report already.
+func (d *ReportDelta) inReport(report *Report) bool {
+	if report == nil {
+		return false
+	}
+	switch {
+	case d.Impressions > 0:
+		return d.Total <= report.Impressions
+	case d.Clicks > 0:
+		return d.Total <= report.Clicks
+	case d.Conversions > 0:
+		return d.Total <= report.Conversions
+	}
+	return false
+}
+
+func (b *localBroker) Publish(advrId string, delta *ReportDelta) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.deliver(advrId, delta)
+}
+
+// deliver hands a delta to the subscribers. Callers hold b.
+func (b *localBroker) deliver(advrId string, delta *ReportDelta) {
+	for ch := range b.subscribers[advrId] {
+		select {
+		case ch <- delta:
+		default:
+			b.remove(advrId, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *localBroker) Subscribe(advrId string) (<-chan *ReportDelta, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	ch := make(chan *ReportDelta, subscriberBuffer)
+	if b.subscribers[advrId] == nil {
+		b.subscribers[advrId] = map[chan *ReportDelta]bool{}
+	}
+	b.subscribers[advrId][ch] = true
+
+	return ch, func() {
+		b.Lock()
+		defer b.Unlock()
+		b.remove(advrId, ch)
+	}
+}
+
+// advertisers returns those with subscribers.
+func (b *localBroker) advertisers() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	ids := make([]string, 0, len(b.subscribers))
+	for advrId := range b.subscribers {
+		ids = append(ids, advrId)
+	}
+	return ids
+}
+
+// forward hands the subscribers a delta published elsewhere.
+func (b *localBroker) forward(advrId string, delta *ReportDelta) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.deliver(advrId, delta)
+}
+
+// remove forgets a subscriber. Callers hold b.
+func (b *localBroker) remove(advrId string, ch chan *ReportDelta) {
+	delete(b.subscribers[advrId], ch)
+	if len(b.subscribers[advrId]) == 0 {
+		delete(b.subscribers, advrId)
+	}
+}
+
+// redisBroker publishes deltas to isu4:report:ADVERTISER. Each process holds one pattern subscription
+// and hands what comes in to its own streams through a localBroker.
+//
+// Which advertisers are streamed anywhere is kept in the isu4:report-watch
+// sorted set, "ADVERTISER NODE" scored by when the entry expires. Every
+// process renews its own entries and reads everyone's each
+// reportWatchRefresh, and publishes only for the advertisers it found.
+type redisBroker struct {
+	sync.Mutex
+
+	rd      *redis.Client
+	local   *localBroker
+	node    string
+	watched map[string]bool
+}
+
+const (
+	reportChannelPrefix = "isu4:report:"
+	reportWatchKey      = "isu4:report-watch"
+
+	reportWatchRefresh = time.Second
+	reportWatchTTL     = 10 * time.Second
+)
+
+func newRedisBroker(rd *redis.Client) *redisBroker {
+	b := &redisBroker{rd: rd, local: newLocalBroker(), node: randomId(), watched: map[string]bool{}}
+	go b.receive()
+	go b.watch()
+	return b
+}
+
+func (b *redisBroker) watch() {
+	for range time.Tick(reportWatchRefresh) {
+		if err := b.refresh(); err != nil {
+			log.Print("report pubsub: ", err)
+		}
+	}
+}
+
+// refresh renews the entries of this process's streams and picks up what
+// the others stream.
+func (b *redisBroker) refresh() error {
+	now := time.Now()
+	defer observeStore("redis-pubsub", "refresh", now)
+	if err := b.renew(b.local.advertisers()...); err != nil {
+		return err
+	}
+	expired := "(" + strconv.FormatInt(now.Unix(), 10)
+	if err := b.rd.ZRemRangeByScore(reportWatchKey, "-inf", expired).Err(); err != nil {
+		return err
+	}
+	members, err := b.rd.ZRangeByScore(reportWatchKey, redis.ZRangeByScore{
+		Min: strconv.FormatInt(now.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	watched := map[string]bool{}
+	for _, member := range members {
+		watched[strings.SplitN(member, " ", 2)[0]] = true
+	}
+	b.Lock()
+	b.watched = watched
+	b.Unlock()
+	return nil
+}
+
+func (b *redisBroker) renew(advrIds ...string) error {
+	if len(advrIds) == 0 {
+		return nil
+	}
+	defer observeStore("redis-pubsub", "renew", time.Now())
+	expires := float64(time.Now().Add(reportWatchTTL).Unix())
+	members := make([]redis.Z, 0, len(advrIds))
+	for _, advrId := range advrIds {
+		members = append(members, redis.Z{Score: expires, Member: advrId + " " + b.node})
+	}
+	return b.rd.ZAdd(reportWatchKey, members...).Err()
+}
+
+func (b *redisBroker) receive() {
+	for {
+		pubsub, err := b.rd.PSubscribe(reportChannelPrefix + "*")
+		if err != nil {
+			log.Print("report pubsub: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for {
+			// ReceiveMessage reconnects by itself on network errors.
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.Print("report pubsub: ", err)
+				break
+			}
+			delta := &ReportDelta{}
+			if json.Unmarshal([]byte(msg.Payload), delta) != nil {
+				continue
+			}
+			b.local.forward(strings.TrimPrefix(msg.Channel, reportChannelPrefix), delta)
+		}
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func (b *redisBroker) Publish(advrId string, delta *ReportDelta) {
+	b.Lock()
+	watched := b.watched[advrId]
+	b.Unlock()
+	if !watched {
+		return
+	}
+	defer observeStore("redis-pubsub", "Publish", time.Now())
+
+	payload, err := json.Marshal(delta)
+	if err != nil {
+		panic(err)
+	}
+	// A lost delta only costs a stream an update, never a request.
+	if err = b.rd.Publish(reportChannelPrefix+advrId, string(payload)).Err(); err != nil {
+		log.Print("report pubsub: ", err)
+	}
+}
+
+// Subscribe returns once every process has had the time to notice the new
+// stream, so that none leaves out a delta it should send.
+func (b *redisBroker) Subscribe(advrId string) (<-chan *ReportDelta, func()) {
+	deltas, cancel := b.local.Subscribe(advrId)
+	if err := b.renew(advrId); err != nil {
+		log.Print("report pubsub: ", err)
+	}
+	b.Lock()
+	b.watched[advrId] = true
+	b.Unlock()
+	time.Sleep(2 * reportWatchRefresh)
+	return deltas, cancel
+}
+
+// streamsClosing is closed when the server shuts down, to end streams
+// that would otherwise keep their connections busy until the shutdown
+// timeout.
+var (
+	streamsClosing   = make(chan struct{})
+	closeStreamsOnce sync.Once
+)
+
+func closeStreams() {
+	closeStreamsOnce.Do(func() { close(streamsClosing) })
+}
+
+const streamHeartbeat = 15 * time.Second
+
+func writeEvent(res http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+func routeGetReportStream(req *http.Request, res http.ResponseWriter) {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		res.WriteHeader(401)
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		res.WriteHeader(500)
+		return
+	}
+
+	// Subscribe before reading the report so that nothing falls in
+	// between; deltas up to the totals it shows are in it already.
+	deltas, cancel := reportBroker.Subscribe(advrId)
+	defer cancel()
+	sent := map[string]*Report{}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(200)
+	fmt.Fprintf(res, "retry: %d\n\n", time.Second/time.Millisecond)
+	eachReport(advrId, false, func(id string, report *Report) {
+		sent[id] = report
+		writeEvent(res, "report", &reportLine{id, report})
+	})
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case delta, ok := <-deltas:
+			if !ok {
+				return
+			}
+			if delta.inReport(sent[delta.AdId]) {
+				continue
+			}
+			if writeEvent(res, "delta", delta) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		case <-streamsClosing:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestReportDeltaInReport(t *testing.T) {
+	report := &Report{Impressions: 5, Clicks: 2, Conversions: 1}
+	cases := []struct {
+		delta ReportDelta
+		want  bool
+	}{
+		{ReportDelta{Impressions: 1, Total: 5}, true},
+		{ReportDelta{Impressions: 1, Total: 6}, false},
+		{ReportDelta{Clicks: 1, Total: 2}, true},
+		{ReportDelta{Clicks: 1, Total: 3}, false},
+		{ReportDelta{Conversions: 1, Total: 1}, true},
+		{ReportDelta{Conversions: 1, Total: 2}, false},
+	}
+	for _, c := range cases {
+		if got := c.delta.inReport(report); got != c.want {
+			t.Errorf("%+v: got %v", c.delta, got)
+		}
+	}
+	if (&ReportDelta{Clicks: 1, Total: 1}).inReport(nil) {
+		t.Error("a delta of an ad missing from the report was left out")
+	}
+}
+
+func TestFileClickStoreRecordTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isu4-clicks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, other := newFileClickStore(dir), newFileClickStore(dir)
+
+	s.Record("a", &ClickLog{AdId: "1", At: time.Now()})
+	// Appended behind the back of s, which has to catch up to count it.
+	other.Record("a", &ClickLog{AdId: "1", At: time.Now()})
+	cases := []struct {
+		click *ClickLog
+		want  int
+	}{
+		{&ClickLog{AdId: "1", At: time.Now()}, 3},
+		{&ClickLog{AdId: "1", At: time.Now(), Invalid: "bot"}, 0},
+		{&ClickLog{AdId: "1", At: time.Now(), Kind: ClickKindConversion, ClickId: "c"}, 1},
+		{&ClickLog{AdId: "2", At: time.Now()}, 1},
+	}
+	for _, c := range cases {
+		if got, err := s.Record("a", c.click); err != nil || got != c.want {
+			t.Errorf("%+v: got %d, %v, want %d", c.click, got, err, c.want)
+		}
+	}
+}
+
+// nextContext stands in for martini's, noting whether the handler after
+// was let through.
+type nextContext struct {
+	martini.Context
+
+	called bool
+}
+
+func (c *nextContext) Next() {
+	c.called = true
+}
+
+func TestStreamTakesSignatureAgain(t *testing.T) {
+	defer useTestStores(t)()
+	advertiserSecret = "secret"
+	defer func() { advertiserSecret = "" }()
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost/me/report/stream", nil)
+		req.Header.Set("X-Advertiser-Id", "1")
+		req.Header.Set("X-Advertiser-Timestamp", ts)
+		digest, cleanup, _ := spoolBody(req)
+		defer cleanup()
+		req.Header.Set("X-Advertiser-Signature", requestSignature(advertiserKeyFor("1"), req, ts, "", digest))
+		return req
+	}
+
+	for i := 0; i < 2; i++ {
+		c := &nextContext{}
+		authAdvertiserStream(c, signed(), &testRender{})
+		if !c.called {
+			t.Errorf("stream %d refused", i)
+		}
+	}
+	c, r := &nextContext{}, &testRender{}
+	authAdvertiser(c, signed(), r)
+	authAdvertiser(c, signed(), r)
+	if r.errorCode() != "replayed" {
+		t.Errorf("replay: got %d %q", r.status, r.errorCode())
+	}
+}
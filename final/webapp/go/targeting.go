@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Targeting restricts an ad to some viewers. An empty list matches anyone;
+// otherwise the viewer's value has to be in it. Generations use the same
+// keys as the final report breakdown ("2" for twenties, "unknown", ...) and
+// agents are browser families.
+type Targeting struct {
+	Genders     []string `json:"genders,omitempty"`
+	Generations []string `json:"generations,omitempty"`
+	Agents      []string `json:"agents,omitempty"`
+}
+
+type Viewer struct {
+	Gender     string
+	Generation string
+	Agent      string
+}
+
+func generationOf(age int) string {
+	if age == -1 {
+		return "unknown"
+	}
+	return strconv.Itoa(age / 10)
+}
+
+func viewerOf(req *http.Request, identity *Identity) *Viewer {
+	return &Viewer{identity.Gender, generationOf(identity.Age), browserFamily(req.Header.Get("User-Agent"))}
+}
+
+func (t *Targeting) Empty() bool {
+	return len(t.Genders) == 0 && len(t.Generations) == 0 && len(t.Agents) == 0
+}
+
+func (t *Targeting) Matches(v *Viewer) bool {
+	return matchesAny(t.Genders, v.Gender) &&
+		matchesAny(t.Generations, v.Generation) &&
+		matchesAny(t.Agents, v.Agent)
+}
+
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// formList collects a list field given either repeated or comma separated.
+func formList(form url.Values, name string) []string {
+	list := []string{}
+	for _, v := range form[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parseTargeting reads target_gender, target_generation and target_agent
+// into t, leaving fields that are not given alone. It returns an error code
+// for the response when a value is not one we could ever match.
+func parseTargeting(form url.Values, t *Targeting) string {
+	if _, given := form["target_gender"]; given {
+		t.Genders = formList(form, "target_gender")
+		for _, g := range t.Genders {
+			if g != "male" && g != "female" && g != "unknown" {
+				return "invalid_target_gender"
+			}
+		}
+	}
+	if _, given := form["target_generation"]; given {
+		t.Generations = formList(form, "target_generation")
+		for _, g := range t.Generations {
+			if n, err := strconv.Atoi(g); g != "unknown" && (err != nil || n < 0) {
+				return "invalid_target_generation"
+			}
+		}
+	}
+	if _, given := form["target_agent"]; given {
+		t.Agents = formList(form, "target_agent")
+		for _, a := range t.Agents {
+			if !matchesAny(browserFamilies, a) {
+				return "invalid_target_agent"
+			}
+		}
+	}
+	return ""
+}
+
+// selectTargeted narrows candidates to the ads aimed at the viewer, or to
+// the untargeted ones when no targeted ad matches.
+func selectTargeted(candidates []*Ad, v *Viewer) []*Ad {
+	targeted := []*Ad{}
+	untargeted := []*Ad{}
+	for _, ad := range candidates {
+		if ad.Targeting.Empty() {
+			untargeted = append(untargeted, ad)
+		} else if ad.Targeting.Matches(v) {
+			targeted = append(targeted, ad)
+		}
+	}
+	if len(targeted) > 0 {
+		return targeted
+	}
+	return untargeted
+}
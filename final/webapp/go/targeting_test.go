@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestTargetingMatches(t *testing.T) {
+	v := &Viewer{"female", "2", "chrome"}
+	cases := []struct {
+		targeting Targeting
+		matches   bool
+	}{
+		{Targeting{}, true},
+		{Targeting{Genders: []string{"female"}}, true},
+		{Targeting{Genders: []string{"male"}}, false},
+		{Targeting{Generations: []string{"1", "2"}, Agents: []string{"chrome"}}, true},
+		{Targeting{Genders: []string{"female"}, Agents: []string{"firefox"}}, false},
+	}
+	for _, c := range cases {
+		if got := c.targeting.Matches(v); got != c.matches {
+			t.Errorf("%+v: got %v, want %v", c.targeting, got, c.matches)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+const maxTimeseriesBuckets = 10000
+
+// seriesRetention is how long impression counts per minute are kept, set
+// by ISU4_SERIES_RETENTION.
+var seriesRetention = newSeriesRetention()
+
+func newSeriesRetention() time.Duration {
+	retention, err := time.ParseDuration(getEnv("ISU4_SERIES_RETENTION", "720h"))
+	if err != nil {
+		panic(err)
+	}
+	return retention
+}
+
+type TimeseriesPoint struct {
+	Time        time.Time `json:"time"`
+	Impressions int       `json:"impressions"`
+	Clicks      int       `json:"clicks"`
+}
+
+type TimeseriesReport struct {
+	Interval string                        `json:"interval"`
+	From     time.Time                     `json:"from"`
+	To       time.Time                     `json:"to"`
+	Ads      map[string][]*TimeseriesPoint `json:"ads"`
+}
+
+// minuteOf is the unix time of the start of the minute t falls in.
+func minuteOf(t time.Time) int64 {
+	return t.Unix() - t.Unix()%60
+}
+
+// hourOf is the unix time of the start of the hour t falls in.
+func hourOf(t time.Time) int64 {
+	return t.Unix() - t.Unix()%3600
+}
+
+func bucketStart(t time.Time, interval string) time.Time {
+	switch interval {
+	case "minute":
+		return t.Truncate(time.Minute)
+	case "hour":
+		return t.Truncate(time.Hour)
+	}
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func nextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case "minute":
+		return t.Add(time.Minute)
+	case "hour":
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// parseTime accepts RFC 3339 or unix seconds.
+func parseTime(s string, def time.Time) (time.Time, bool) {
+	if s == "" {
+		return def, true
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t.Local(), err == nil
+}
+
+func routeGetReportTimeseries(req *http.Request, r render.Render) {
+	advrId := advertiserId(req)
+
+	if advrId == "" {
+		r.Status(401)
+		return
+	}
+
+	query := req.URL.Query()
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	if interval != "minute" && interval != "hour" && interval != "day" {
+		r.JSON(400, map[string]string{"error": "invalid_interval"})
+		return
+	}
+	to, ok := parseTime(query.Get("to"), time.Now())
+	if !ok {
+		r.JSON(400, map[string]string{"error": "invalid_to"})
+		return
+	}
+	from, ok := parseTime(query.Get("from"), to.Add(-24*time.Hour))
+	if !ok {
+		r.JSON(400, map[string]string{"error": "invalid_from"})
+		return
+	}
+	if !from.Before(to) {
+		r.JSON(400, map[string]string{"error": "invalid_range"})
+		return
+	}
+
+	buckets := []time.Time{}
+	positions := map[int64]int{}
+	for t := bucketStart(from, interval); t.Before(to); t = nextBucket(t, interval) {
+		if len(buckets) == maxTimeseriesBuckets {
+			r.JSON(400, map[string]string{"error": "too_many_buckets"})
+			return
+		}
+		positions[t.Unix()] = len(buckets)
+		buckets = append(buckets, t)
+	}
+	start := buckets[0]
+	index := func(minute int64) int {
+		i, exists := positions[bucketStart(time.Unix(minute, 0), interval).Unix()]
+		if !exists {
+			return -1
+		}
+		return i
+	}
+
+	aggs, err := clicks.Aggregates(advrId, AggregateMinutes)
+	if err != nil {
+		panic(err)
+	}
+
+	// Click minutes can outlive seriesRetention a little, until they are
+	// trimmed; they are left out like the expired impressions.
+	oldest := minuteOf(time.Now().Add(-seriesRetention))
+	report := &TimeseriesReport{interval, from, to, map[string][]*TimeseriesPoint{}}
+	for _, ad := range store.AdvertiserAds(advrId) {
+		points := make([]*TimeseriesPoint, len(buckets))
+		for i, t := range buckets {
+			points[i] = &TimeseriesPoint{Time: t}
+		}
+		for minute, n := range store.ImpressionSeries(ad.Slot, ad.Id, start, to) {
+			if i := index(minute); i >= 0 {
+				points[i].Impressions += n
+			}
+		}
+		if agg, exists := aggs[ad.Id]; exists {
+			for minute, n := range agg.Minutes {
+				if minute < start.Unix() || minute < oldest || minute >= to.Unix() {
+					continue
+				}
+				if i := index(minute); i >= 0 {
+					points[i].Clicks += n
+				}
+			}
+		}
+		report.Ads[ad.Id] = points
+	}
+
+	r.JSON(200, report)
+}
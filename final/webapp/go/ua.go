@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var browserFamilies = []string{
+	"edge", "opera", "chrome", "firefox", "ie", "android", "safari", "other", "unknown",
+}
+
+// browserFamily reduces a User-Agent to a coarse browser family. Order
+// matters: most engines also claim to be Safari or Mozilla.
+func browserFamily(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "Edge/"):
+		return "edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		return "opera"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/"):
+		return "chrome"
+	case strings.Contains(ua, "Firefox/"):
+		return "firefox"
+	case strings.Contains(ua, "MSIE") || strings.Contains(ua, "Trident/"):
+		return "ie"
+	case strings.Contains(ua, "Android") && strings.Contains(ua, "Safari/"):
+		return "android"
+	case strings.Contains(ua, "Safari/"):
+		return "safari"
+	}
+	return "other"
+}
+
+// UserAgent is what the reports break clicks down by. OS is the family
+// followed by its version when the User-Agent tells it, as in "ios 8.1",
+// "android 4.4" or "windows 7".
+type UserAgent struct {
+	Device  string
+	OS      string
+	Browser string
+}
+
+var (
+	windowsPhonePattern = regexp.MustCompile(`Windows Phone(?: OS)? (\d+\.\d+)`)
+	iosPattern          = regexp.MustCompile(`(?:iPhone|CPU) OS (\d+)_(\d+)`)
+	androidPattern      = regexp.MustCompile(`Android (\d+(?:\.\d+)?)`)
+	windowsPattern      = regexp.MustCompile(`Windows (?:NT )?(\d+\.\d+)`)
+	macPattern          = regexp.MustCompile(`Mac OS X (\d+)[._](\d+)`)
+)
+
+// windowsVersions names Windows releases by their NT version.
+var windowsVersions = map[string]string{
+	"5.0":  "2000",
+	"5.1":  "xp",
+	"5.2":  "xp",
+	"6.0":  "vista",
+	"6.1":  "7",
+	"6.2":  "8",
+	"6.3":  "8.1",
+	"10.0": "10",
+}
+
+func parseUserAgent(ua string) *UserAgent {
+	if ua == "" {
+		return &UserAgent{"unknown", "unknown", "unknown"}
+	}
+	return &UserAgent{deviceClass(ua), osOf(ua), browserFamily(ua)}
+}
+
+// deviceClass tells mobile, tablet and desktop apart. Android tablets are
+// the Android devices that leave "Mobile" out.
+func deviceClass(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"), strings.Contains(ua, "Kindle"),
+		strings.Contains(ua, "Silk/"), strings.Contains(ua, "PlayBook"):
+		return "tablet"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"), strings.Contains(ua, "Windows Phone"),
+		strings.Contains(ua, "BlackBerry"), strings.Contains(ua, "Opera Mini"), strings.Contains(ua, "Mobile"):
+		return "mobile"
+	case strings.Contains(ua, "Android"):
+		return "tablet"
+	}
+	return "desktop"
+}
+
+func osOf(ua string) string {
+	if m := windowsPhonePattern.FindStringSubmatch(ua); m != nil {
+		return "windows phone " + m[1]
+	}
+	if m := iosPattern.FindStringSubmatch(ua); m != nil {
+		return "ios " + m[1] + "." + m[2]
+	}
+	if m := androidPattern.FindStringSubmatch(ua); m != nil {
+		return "android " + m[1]
+	}
+	if m := windowsPattern.FindStringSubmatch(ua); m != nil {
+		if name, exists := windowsVersions[m[1]]; exists {
+			return "windows " + name
+		}
+		return "windows nt " + m[1]
+	}
+	if m := macPattern.FindStringSubmatch(ua); m != nil {
+		return "mac os x " + m[1] + "." + m[2]
+	}
+	switch {
+	case strings.Contains(ua, "Android"):
+		return "android"
+	case strings.Contains(ua, "Windows"):
+		return "windows"
+	case strings.Contains(ua, "Macintosh"):
+		return "mac os x"
+	case strings.Contains(ua, "CrOS"):
+		return "chrome os"
+	case strings.Contains(ua, "Linux"):
+		return "linux"
+	}
+	return "other"
+}
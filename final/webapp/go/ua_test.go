@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		ua   string
+		want UserAgent
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 6_0 like Mac OS X) AppleWebKit/536.26 (KHTML, like Gecko) Version/6.0 Mobile/10A403 Safari/8536.25",
+			UserAgent{"mobile", "ios 6.0", "safari"}},
+		{"Mozilla/5.0 (iPad; CPU OS 6_0 like Mac OS X) AppleWebKit/536.26 (KHTML, like Gecko) Version/6.0 Mobile/10A403 Safari/8536.25",
+			UserAgent{"tablet", "ios 6.0", "safari"}},
+		{"Mozilla/5.0 (Linux; U; Android 3.2.1; ja-jp; Transformer TF101 Build/HTK75) AppleWebKit/534.13 (KHTML, like Gecko) Version/4.0 Safari/534.13",
+			UserAgent{"tablet", "android 3.2", "android"}},
+		{"Mozilla/5.0 (Linux; U; Android 4.0.4; ja-jp; SC-06D Build/IMM76D) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 Mobile Safari/534.30",
+			UserAgent{"mobile", "android 4.0", "android"}},
+		{"Mozilla/4.0 (compatible; GoogleToolbar 5.0.2124.2070; Windows 6.0; MSIE 8.0.6001.18241)",
+			UserAgent{"desktop", "windows vista", "ie"}},
+		{"Mozilla/5.0 (Windows NT 6.1; WOW64; rv:9.0.1) Gecko/20100101 Firefox/9.0.1",
+			UserAgent{"desktop", "windows 7", "firefox"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8) AppleWebKit/536.25 (KHTML, like Gecko) Version/6.0 Safari/536.25",
+			UserAgent{"desktop", "mac os x 10.8", "safari"}},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/28.0.1500.52 Safari/537.36",
+			UserAgent{"desktop", "linux", "chrome"}},
+		{"", UserAgent{"unknown", "unknown", "unknown"}},
+	}
+	for _, c := range cases {
+		if got := *parseUserAgent(c.ua); got != c.want {
+			t.Errorf("%q: got %+v, want %+v", c.ua, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Creatives too large to send in one request are uploaded in chunks, much
+// like tus (https://tus.io):
+//
+//	POST   /slots/:slot/uploads          Upload-Length: 52428800, form fields of POST /ads
+//	PATCH  /slots/:slot/uploads/:upload  Upload-Offset: 0, body is the next chunk
+//	HEAD   /slots/:slot/uploads/:upload  answers Upload-Offset to resume from
+//	DELETE /slots/:slot/uploads/:upload  gives up
+//
+// The chunk that completes the upload also creates the ad, which is
+// answered like POST /ads. Until then nothing is visible in the slot.
+
+var ErrUploadOverflow = errors.New("Upload longer than announced")
+
+const uploadTTL = 24 * time.Hour
+
+var uploadIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Upload is a resumable upload session. Offset is how much of the creative
+// has arrived; it is read off the data file rather than stored. Once the
+// upload completes, AdId names the ad it became.
+type Upload struct {
+	Id         string     `json:"id"`
+	Slot       string     `json:"slot"`
+	Advertiser string     `json:"advertiser"`
+	Length     int64      `json:"length"`
+	Offset     int64      `json:"offset"`
+	Fields     url.Values `json:"fields"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AdId       string     `json:"ad_id,omitempty"`
+
+	meta *os.File
+}
+
+// UploadStore keeps upload sessions on disk: <id>.json holds the session
+// and doubles as its lock, <id> the bytes received so far. Being on disk,
+// uploads survive restarts and can be resumed against any process sharing
+// the directory.
+type UploadStore struct {
+	dir string
+}
+
+func newUploadStore(dir string) *UploadStore {
+	os.MkdirAll(dir, 0755)
+	return &UploadStore{dir}
+}
+
+func (s *UploadStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *UploadStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *UploadStore) Create(u *Upload) error {
+	s.expire(time.Now())
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	u.Id = hex.EncodeToString(buf)
+	u.CreatedAt = time.Now()
+
+	data, err := os.OpenFile(s.dataPath(u.Id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	data.Close()
+
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	path := s.metaPath(u.Id)
+	if err = ioutil.WriteFile(path+".tmp", body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// open loads the session with its meta file locked as given. Expired
+// sessions are treated as gone.
+func (s *UploadStore) open(id string, how int) (*Upload, error) {
+	if !uploadIdPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.OpenFile(s.metaPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	u := &Upload{}
+	if err = json.NewDecoder(f).Decode(u); err != nil {
+		f.Close()
+		return nil, err
+	}
+	u.meta = f
+	if u.AdId != "" {
+		u.Offset = u.Length
+		return u, nil
+	}
+	if time.Since(u.CreatedAt) > uploadTTL {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	return u, nil
+}
+
+// Get loads a session for reading. Close it when done.
+func (s *UploadStore) Get(id string) (*Upload, error) {
+	return s.open(id, syscall.LOCK_SH)
+}
+
+// Lock loads a session for exclusive use, so that chunks of one upload are
+// appended one at a time and it completes once. Close it to release.
+func (s *UploadStore) Lock(id string) (*Upload, error) {
+	return s.open(id, syscall.LOCK_EX)
+}
+
+func (u *Upload) Close() error {
+	return u.meta.Close()
+}
+
+// Append writes the next chunk of a locked session. A client that goes away
+// mid chunk keeps what arrived, which is the point of resuming. A chunk
+// running past Length is dropped entirely.
+func (s *UploadStore) Append(u *Upload, r io.Reader) error {
+	f, err := os.OpenFile(s.dataPath(u.Id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := u.Offset
+	buf := make([]byte, 32*1024)
+	for u.Offset < u.Length {
+		want := int64(len(buf))
+		if rest := u.Length - u.Offset; rest < want {
+			want = rest
+		}
+		n, rerr := r.Read(buf[:want])
+		if n > 0 {
+			if _, err = f.Write(buf[:n]); err != nil {
+				return err
+			}
+			u.Offset += int64(n)
+		}
+		if rerr != nil {
+			return nil
+		}
+	}
+
+	if n, _ := r.Read(buf[:1]); n > 0 {
+		u.Offset = start
+		if err = f.Truncate(start); err != nil {
+			return err
+		}
+		return ErrUploadOverflow
+	}
+	return nil
+}
+
+// Complete records the ad a locked session became and drops its data.
+func (s *UploadStore) Complete(u *Upload, adId string) error {
+	u.AdId = adId
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err = u.meta.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = u.meta.WriteAt(body, 0); err != nil {
+		return err
+	}
+	return os.Remove(s.dataPath(u.Id))
+}
+
+func (s *UploadStore) Remove(id string) error {
+	os.Remove(s.dataPath(id))
+	return os.Remove(s.metaPath(id))
+}
+
+// expire removes sessions abandoned for longer than uploadTTL.
+func (s *UploadStore) expire(now time.Time) {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err == nil && now.Sub(fi.ModTime()) > uploadTTL {
+			id := filepath.Base(path)
+			s.Remove(id[:len(id)-len(".json")])
+		}
+	}
+}
+
+func (s *UploadStore) Clear() error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, 0755)
+}
+
+func setUploadHeaders(res http.ResponseWriter, u *Upload) {
+	res.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	res.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	res.Header().Set("Cache-Control", "no-store")
+}
+
+// ownedUpload loads the session named by the route for the requesting
+// advertiser, locked as exclusive says. It writes the error response itself
+// and returns nil when the request must not go on.
+func ownedUpload(r render.Render, req *http.Request, params martini.Params, exclusive bool) *Upload {
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return nil
+	}
+
+	var u *Upload
+	var err error
+	if exclusive {
+		u, err = uploads.Lock(params["upload"])
+	} else {
+		u, err = uploads.Get(params["upload"])
+	}
+	if os.IsNotExist(err) {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	if u.Slot != params["slot"] {
+		u.Close()
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return nil
+	}
+	if u.Advertiser != advrId {
+		u.Close()
+		r.JSON(403, map[string]string{"error": "forbidden"})
+		return nil
+	}
+	return u
+}
+
+func routePostUpload(r render.Render, req *http.Request, res http.ResponseWriter, params martini.Params) {
+	slot := params["slot"]
+
+	advrId := advertiserId(req)
+	if advrId == "" {
+		r.Status(401)
+		return
+	}
+
+	if err := req.ParseMultipartForm(100000); err != nil && err != http.ErrNotMultipart {
+		r.JSON(400, map[string]string{"error": "invalid_form"})
+		return
+	}
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+
+	length := req.Header.Get("Upload-Length")
+	if length == "" {
+		length = req.Form.Get("length")
+	}
+	size, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || size <= 0 {
+		r.JSON(400, &ErrorResponse{Error: "invalid_length", Field: "length"})
+		return
+	}
+
+	// Reject what we can before the client sends the whole creative.
+	declared := req.Form.Get("type")
+	if declared != "" && !matchesAny(supportedTypes, declared) {
+		r.JSON(415, &ErrorResponse{Error: "unsupported_type", Field: "type", Allowed: supportedTypes})
+		return
+	}
+	if info := store.GetSlot(slot); info != nil {
+		check := *info
+		if declared == "" {
+			check.MimeTypes = nil
+		}
+		if e := check.checkAsset(&MediaInfo{Type: declared, Size: size}); e != nil {
+			r.JSON(400, e)
+			return
+		}
+	}
+	scratch := &Ad{Weight: 1}
+	if code := parseDelivery(req.Form, scratch); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+	if code := parseTargeting(req.Form, &scratch.Targeting); code != "" {
+		r.JSON(400, map[string]string{"error": code})
+		return
+	}
+
+	u := &Upload{
+		Slot:       slot,
+		Advertiser: advrId,
+		Length:     size,
+		Fields:     req.Form,
+	}
+	if err := uploads.Create(u); err != nil {
+		panic(err)
+	}
+
+	res.Header().Set("Location", urlFor(req, "/slots/"+slot+"/uploads/"+u.Id))
+	setUploadHeaders(res, u)
+	r.JSON(201, u)
+}
+
+func routeGetUpload(r render.Render, req *http.Request, res http.ResponseWriter, params martini.Params) {
+	u := ownedUpload(r, req, params, false)
+	if u == nil {
+		return
+	}
+	defer u.Close()
+
+	setUploadHeaders(res, u)
+	r.JSON(200, u)
+}
+
+func routePatchUpload(r render.Render, req *http.Request, res http.ResponseWriter, params martini.Params) {
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		r.JSON(400, map[string]string{"error": "invalid_offset"})
+		return
+	}
+
+	u := ownedUpload(r, req, params, true)
+	if u == nil {
+		return
+	}
+	defer u.Close()
+
+	// A retried final chunk finds the upload already done.
+	if u.AdId != "" {
+		setUploadHeaders(res, u)
+		if offset != u.Length {
+			r.JSON(409, map[string]string{"error": "offset_mismatch"})
+			return
+		}
+		r.JSON(201, getAd(req, u.Slot, u.AdId))
+		return
+	}
+
+	if offset != u.Offset {
+		setUploadHeaders(res, u)
+		r.JSON(409, map[string]string{"error": "offset_mismatch"})
+		return
+	}
+	err = uploads.Append(u, req.Body)
+	setUploadHeaders(res, u)
+	if err == ErrUploadOverflow {
+		r.JSON(413, &ErrorResponse{Error: "upload_too_large", Allowed: u.Length})
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	if u.Offset < u.Length {
+		r.Status(204)
+		return
+	}
+
+	f, err := os.Open(uploads.dataPath(u.Id))
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	ad, status, e := createAd(u.Slot, u.Advertiser, u.Fields, f, u.Length, u.Fields.Get("type"))
+	if e != nil {
+		// The complete creative is what it is; resuming cannot fix it.
+		uploads.Remove(u.Id)
+		r.JSON(status, e)
+		return
+	}
+	if err = uploads.Complete(u, ad.Id); err != nil {
+		panic(err)
+	}
+
+	r.JSON(201, getAd(req, ad.Slot, ad.Id))
+}
+
+func routeDeleteUpload(r render.Render, req *http.Request, params martini.Params) {
+	u := ownedUpload(r, req, params, true)
+	if u == nil {
+		return
+	}
+	defer u.Close()
+
+	if err := uploads.Remove(u.Id); err != nil {
+		panic(err)
+	}
+	r.Status(204)
+}
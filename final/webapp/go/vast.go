@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// GET /slots/:slot/ad answers in one of three ways, picked by the format
+// parameter or else the Accept header:
+//
+//	redirect  to /slots/:slot/ads/:id, as it always did (the default)
+//	json      the ad inline, as JSON-P when a callback is given
+//	vast      a VAST 3.0 document video players load directly
+//
+// VAST players fire the impression tracker with GET, which is why the
+// counter also answers GET.
+
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$.]*$`)
+
+func adFormat(req *http.Request) string {
+	query := req.URL.Query()
+	if format := query.Get("format"); format != "" {
+		switch format {
+		case "redirect", "json", "vast":
+			return format
+		}
+		return ""
+	}
+	if query.Get("callback") != "" {
+		return "json"
+	}
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	case strings.Contains(accept, "text/html"):
+		// Browsers list XML too; they want the redirect.
+		return "redirect"
+	case strings.Contains(accept, "application/xml"), strings.Contains(accept, "text/xml"):
+		return "vast"
+	}
+	return "redirect"
+}
+
+type Vast struct {
+	XMLName xml.Name `xml:"VAST"`
+	Version string   `xml:"version,attr"`
+	Ads     []VastAd `xml:"Ad"`
+}
+
+type VastAd struct {
+	Id         string         `xml:"id,attr"`
+	AdSystem   string         `xml:"InLine>AdSystem"`
+	AdTitle    string         `xml:"InLine>AdTitle"`
+	Impression vastURL        `xml:"InLine>Impression"`
+	Creatives  []VastCreative `xml:"InLine>Creatives>Creative"`
+}
+
+type VastCreative struct {
+	Id           string          `xml:"id,attr"`
+	Duration     string          `xml:"Linear>Duration"`
+	MediaFiles   []VastMediaFile `xml:"Linear>MediaFiles>MediaFile"`
+	ClickThrough vastURL         `xml:"Linear>VideoClicks>ClickThrough"`
+}
+
+type VastMediaFile struct {
+	Delivery string `xml:"delivery,attr"`
+	Type     string `xml:"type,attr"`
+	Width    int    `xml:"width,attr"`
+	Height   int    `xml:"height,attr"`
+	URL      string `xml:",cdata"`
+}
+
+type vastURL struct {
+	URL string `xml:",cdata"`
+}
+
+// vastDuration formats seconds as VAST's HH:MM:SS.mmm.
+func vastDuration(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// newVast describes the ad in VAST; without an ad the document is empty,
+// which is how VAST says there is nothing to play.
+func newVast(ad *AdWithEndpoints) *Vast {
+	vast := &Vast{Version: "3.0", Ads: []VastAd{}}
+	if ad == nil {
+		return vast
+	}
+
+	media := VastMediaFile{Delivery: "progressive", Type: ad.Type, URL: ad.Asset}
+	duration := 0.0
+	if ad.Media != nil {
+		media.Width, media.Height = ad.Media.Width, ad.Media.Height
+		duration = ad.Media.Duration
+	}
+	vast.Ads = append(vast.Ads, VastAd{
+		Id:         ad.Id,
+		AdSystem:   "isucon4",
+		AdTitle:    ad.Title,
+		Impression: vastURL{ad.Counter},
+		Creatives: []VastCreative{{
+			Id:           ad.Id,
+			Duration:     vastDuration(duration),
+			MediaFiles:   []VastMediaFile{media},
+			ClickThrough: vastURL{ad.Redirect},
+		}},
+	})
+	return vast
+}
+
+func writeVast(res http.ResponseWriter, ad *AdWithEndpoints) {
+	body, err := xml.Marshal(newVast(ad))
+	if err != nil {
+		panic(err)
+	}
+	res.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(200)
+	res.Write([]byte(xml.Header))
+	res.Write(body)
+}
+
+// writeJSONP answers 200 whatever the payload: a script tag only gets to
+// see the body.
+func writeJSONP(res http.ResponseWriter, callback string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	res.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(200)
+	fmt.Fprintf(res, "/**/%s(%s);", callback, body)
+}
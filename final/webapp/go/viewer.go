@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+// Viewers are known by an opaque ID the app issues in the isu4_viewer
+// cookie. What they tell us about themselves is kept server-side as their
+// Profile, set through
+//
+//	GET|PUT|DELETE /viewer/profile   gender=male|female age=N
+//
+// A viewer without an ID is still told apart by a well-formed isuad cookie
+// ("gender/age", 0 for female), which clients used to set themselves. Once
+// a viewer has an ID its isuad is ignored, so one that sends isuad is only
+// issued an ID when it saves a profile.
+//
+// Only viewers whose isu4_profile cookie says they saved a profile have it
+// looked up, so that the rest cost no store round trip per request.
+//
+// A viewer who sends "DNT: 1", or opted out through POST /viewer/opt-out,
+// is not tracked: no ID is issued, cookies are ignored and the profile is
+// wiped. DELETE /viewer/opt-out opts back in.
+
+const (
+	viewerCookie  = "isu4_viewer"
+	profileCookie = "isu4_profile"
+	optOutCookie  = "isu4_optout"
+
+	maxViewerAge = 150
+)
+
+var viewerIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var profileTTL = newProfileTTL()
+
+func newProfileTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("ISU4_PROFILE_TTL", "2160h"))
+	if err != nil {
+		panic(err)
+	}
+	return ttl
+}
+
+type Profile struct {
+	Gender    string    `json:"gender"`
+	Age       int       `json:"age"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Identity is who a request comes from, as far as targeting, frequency
+// capping and click filtering are concerned.
+type Identity struct {
+	// ViewerId is the isu4_viewer cookie, "" without a valid one.
+	ViewerId string
+	// Key tells the viewer apart from others, "" for an unknown viewer.
+	Key      string
+	Gender   string
+	Age      int
+	Address  string
+	OptedOut bool
+}
+
+// UserKey is the viewer in the "gender/age" form the click log keeps.
+func (i *Identity) UserKey() string {
+	return encodeUserKey(i.Gender, i.Age)
+}
+
+func encodeUserKey(gender string, age int) string {
+	switch gender {
+	case "female":
+		return "0/" + strconv.Itoa(age)
+	case "male":
+		return "1/" + strconv.Itoa(age)
+	}
+	return ""
+}
+
+// parseUserKey reads a "gender/age" key, reporting false for a malformed
+// one.
+func parseUserKey(key string) (string, int, bool) {
+	splitted := strings.Split(key, "/")
+	if len(splitted) != 2 {
+		return "", 0, false
+	}
+	age, err := strconv.Atoi(splitted[1])
+	if err != nil || age < 0 || age > maxViewerAge {
+		return "", 0, false
+	}
+	switch splitted[0] {
+	case "0":
+		return "female", age, true
+	case "1":
+		return "male", age, true
+	}
+	return "", 0, false
+}
+
+func optedOut(req *http.Request) bool {
+	if req.Header.Get("DNT") == "1" {
+		return true
+	}
+	cookie, err := req.Cookie(optOutCookie)
+	return err == nil && cookie.Value == "1"
+}
+
+// hasProfile reports whether the viewer says they saved a profile. Saying
+// so wrongly only costs a lookup.
+func hasProfile(req *http.Request) bool {
+	cookie, err := req.Cookie(profileCookie)
+	return err == nil && cookie.Value == "1"
+}
+
+func viewerIdOf(req *http.Request) string {
+	if cookie, err := req.Cookie(viewerCookie); err == nil && viewerIdPattern.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+	return ""
+}
+
+func identify(req *http.Request) *Identity {
+	identity := &Identity{Gender: "unknown", Age: -1, Address: remoteIP(req)}
+	if optedOut(req) {
+		identity.OptedOut = true
+		return identity
+	}
+
+	identity.ViewerId = viewerIdOf(req)
+	if identity.ViewerId != "" {
+		identity.Key = "v:" + identity.ViewerId
+		if hasProfile(req) {
+			if profile := store.GetProfile(identity.ViewerId); profile != nil {
+				identity.Gender, identity.Age = profile.Gender, profile.Age
+			}
+		}
+		return identity
+	}
+	if cookie, err := req.Cookie("isuad"); err == nil {
+		if gender, age, ok := parseUserKey(cookie.Value); ok {
+			identity.Key = "u:" + cookie.Value
+			identity.Gender, identity.Age = gender, age
+		}
+	}
+	return identity
+}
+
+func newViewerId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func setViewerCookie(res http.ResponseWriter, name string, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+	}
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(res, cookie)
+}
+
+// trackViewer issues an ID to a viewer who is known by neither an ID nor
+// an isuad cookie, and forgets one who opted out.
+func trackViewer(res http.ResponseWriter, req *http.Request, identity *Identity) {
+	if identity.OptedOut {
+		if viewerId := viewerIdOf(req); viewerId != "" {
+			forgetViewer(res, viewerId)
+		}
+		return
+	}
+	if identity.ViewerId == "" && identity.Key == "" {
+		identity.ViewerId = newViewerId()
+		setViewerCookie(res, viewerCookie, identity.ViewerId, profileTTL)
+	}
+}
+
+func forgetViewer(res http.ResponseWriter, viewerId string) {
+	if err := store.DeleteProfile(viewerId); err != nil {
+		panic(err)
+	}
+	setViewerCookie(res, viewerCookie, "", 0)
+	setViewerCookie(res, profileCookie, "", 0)
+}
+
+func routeGetViewerProfile(r render.Render, req *http.Request) {
+	viewerId := viewerIdOf(req)
+	if viewerId == "" || optedOut(req) {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	profile := store.GetProfile(viewerId)
+	if profile == nil {
+		r.JSON(404, map[string]string{"error": "not_found"})
+		return
+	}
+	r.JSON(200, profile)
+}
+
+func routePutViewerProfile(r render.Render, res http.ResponseWriter, req *http.Request) {
+	identity := identify(req)
+	if identity.OptedOut {
+		trackViewer(res, req, identity)
+		r.JSON(403, map[string]string{"error": "opted_out"})
+		return
+	}
+
+	req.ParseForm()
+	gender := req.Form.Get("gender")
+	if gender != "male" && gender != "female" {
+		r.JSON(400, &ErrorResponse{Error: "invalid_gender", Field: "gender", Allowed: []string{"male", "female"}})
+		return
+	}
+	age, err := strconv.Atoi(req.Form.Get("age"))
+	if err != nil || age < 0 || age > maxViewerAge {
+		r.JSON(400, &ErrorResponse{Error: "invalid_age", Message: "age must be 0 to " + strconv.Itoa(maxViewerAge), Field: "age"})
+		return
+	}
+
+	if identity.ViewerId == "" {
+		identity.ViewerId = newViewerId()
+	}
+	profile := &Profile{gender, age, time.Now()}
+	if err = store.SaveProfile(identity.ViewerId, profile, profileTTL); err != nil {
+		panic(err)
+	}
+	// The cookies live as long as the profile they point to.
+	setViewerCookie(res, viewerCookie, identity.ViewerId, profileTTL)
+	setViewerCookie(res, profileCookie, "1", profileTTL)
+	r.JSON(200, profile)
+}
+
+func routeDeleteViewerProfile(r render.Render, res http.ResponseWriter, req *http.Request) {
+	if viewerId := viewerIdOf(req); viewerId != "" {
+		if err := store.DeleteProfile(viewerId); err != nil {
+			panic(err)
+		}
+	}
+	setViewerCookie(res, profileCookie, "", 0)
+	r.Status(204)
+}
+
+func routePostViewerOptOut(r render.Render, res http.ResponseWriter, req *http.Request) {
+	if viewerId := viewerIdOf(req); viewerId != "" {
+		forgetViewer(res, viewerId)
+	}
+	setViewerCookie(res, optOutCookie, "1", 5*365*24*time.Hour)
+	r.Status(204)
+}
+
+func routeDeleteViewerOptOut(r render.Render, res http.ResponseWriter) {
+	setViewerCookie(res, optOutCookie, "", 0)
+	r.Status(204)
+}
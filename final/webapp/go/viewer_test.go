@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUserKey(t *testing.T) {
+	cases := []struct {
+		key    string
+		gender string
+		age    int
+		ok     bool
+	}{
+		{"0/25", "female", 25, true},
+		{"1/0", "male", 0, true},
+		{"1/150", "male", 150, true},
+		{"1/151", "", 0, false},
+		{"1/-1", "", 0, false},
+		{"2/30", "", 0, false},
+		{"1/x", "", 0, false},
+		{"1/", "", 0, false},
+		{"1", "", 0, false},
+		{"1/30/2", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, c := range cases {
+		gender, age, ok := parseUserKey(c.key)
+		if gender != c.gender || age != c.age || ok != c.ok {
+			t.Errorf("%q: got %q, %d, %v, want %q, %d, %v", c.key, gender, age, ok, c.gender, c.age, c.ok)
+		}
+	}
+}
+
+func TestViewerOfMalformedCookie(t *testing.T) {
+	cases := []struct {
+		cookie     string
+		gender     string
+		generation string
+	}{
+		{"0/25", "female", "2"},
+		{"1/7", "male", "0"},
+		{"", "unknown", "unknown"},
+		{"1", "unknown", "unknown"},
+		{"/", "unknown", "unknown"},
+		{"1/", "unknown", "unknown"},
+		{"2/30", "unknown", "unknown"},
+		{"1/x", "unknown", "unknown"},
+		{"1/-5", "unknown", "unknown"},
+		{"1/30/2", "unknown", "unknown"},
+		{"1/99999999999999999999", "unknown", "unknown"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/slots/s/ad", nil)
+		req.AddCookie(&http.Cookie{Name: "isuad", Value: c.cookie})
+		v := viewerOf(req, identify(req))
+		if v.Gender != c.gender || v.Generation != c.generation {
+			t.Errorf("isuad %q: got %s/%s, want %s/%s", c.cookie, v.Gender, v.Generation, c.gender, c.generation)
+		}
+	}
+}
+
+func TestIdentifyKeepsViewerId(t *testing.T) {
+	defer useTestStores(t)()
+
+	viewerId := newViewerId()
+	store.SaveProfile(viewerId, &Profile{"male", 41, time.Now()}, time.Hour)
+	cases := []struct {
+		profileCookie bool
+		gender        string
+		age           int
+	}{
+		{false, "unknown", -1},
+		{true, "male", 41},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/slots/s/ad", nil)
+		req.AddCookie(&http.Cookie{Name: viewerCookie, Value: viewerId})
+		req.AddCookie(&http.Cookie{Name: "isuad", Value: "0/25"})
+		if c.profileCookie {
+			req.AddCookie(&http.Cookie{Name: profileCookie, Value: "1"})
+		}
+		identity := identify(req)
+		if identity.Key != "v:"+viewerId || identity.Gender != c.gender || identity.Age != c.age {
+			t.Errorf("profile cookie %v: got %s %s/%d, want v:%s %s/%d", c.profileCookie,
+				identity.Key, identity.Gender, identity.Age, viewerId, c.gender, c.age)
+		}
+	}
+}
+
+func TestTrackViewerIssuesIds(t *testing.T) {
+	cases := []struct {
+		cookies []*http.Cookie
+		dnt     bool
+		issued  bool
+	}{
+		{nil, false, true},
+		{[]*http.Cookie{{Name: "isuad", Value: "x"}}, false, true},
+		{[]*http.Cookie{{Name: "isuad", Value: "0/25"}}, false, false},
+		{[]*http.Cookie{{Name: viewerCookie, Value: newViewerId()}}, false, false},
+		{nil, true, false},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", "/slots/s/ad", nil)
+		for _, cookie := range c.cookies {
+			req.AddCookie(cookie)
+		}
+		if c.dnt {
+			req.Header.Set("DNT", "1")
+		}
+		rec := httptest.NewRecorder()
+		trackViewer(rec, req, identify(req))
+		issued := strings.Contains(rec.Header().Get("Set-Cookie"), viewerCookie+"=")
+		if issued != c.issued {
+			t.Errorf("case %d: issued %v, want %v", i, issued, c.issued)
+		}
+	}
+}